@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/example/wireguard-gateway/internal/events"
+)
+
+// AuthConfig holds authentication settings.
+type AuthConfig struct {
+	Basic BasicAuthConfig `json:"basic"`
+	JWT   JWTConfig       `json:"jwt"`
+}
+
+// BasicAuthConfig describes HTTP basic authentication credentials.
+type BasicAuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// JWTConfig describes JWT validation settings.
+type JWTConfig struct {
+	Secret string `json:"secret"`
+}
+
+// BootstrapConfig describes how the gateway creates and owns the WireGuard interface.
+type BootstrapConfig struct {
+	Enabled        bool   `json:"enabled"`
+	PrivateKeyPath string `json:"private_key_path"`
+	ListenPort     int    `json:"listen_port"`
+	FirewallMark   int    `json:"firewall_mark"`
+	Address        string `json:"address"`
+	MTU            int    `json:"mtu"`
+	TeardownOnExit bool   `json:"teardown_on_exit"`
+}
+
+// TracingConfig describes the OTLP/HTTP export of trace spans. Tracing is
+// off when no endpoint is set.
+type TracingConfig struct {
+	Endpoint    string `json:"otlp_endpoint"`
+	Insecure    bool   `json:"insecure"`
+	ServiceName string `json:"service_name"`
+}
+
+// AuditConfig describes the audit log. It is off when no path is set.
+// Unset MaxSizeMB and MaxBackups default to defaultAuditMaxSizeMB and
+// defaultAuditMaxBackups; 0 disables the limit.
+type AuditConfig struct {
+	Path       string `json:"path"`
+	MaxSizeMB  *int   `json:"max_size_mb"`
+	MaxBackups *int   `json:"max_backups"`
+	HashChain  bool   `json:"hash_chain"`
+}
+
+const (
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxBackups = 10
+)
+
+// WebhooksConfig describes the webhook targets notified of peer events.
+type WebhooksConfig struct {
+	OutboxDir   string                `json:"outbox_dir"`
+	MaxAttempts int                   `json:"max_attempts"`
+	Targets     []WebhookTargetConfig `json:"targets"`
+}
+
+// WebhookTargetConfig describes one webhook endpoint.
+type WebhookTargetConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// webhookEvents lists the event types targets can subscribe to.
+var webhookEvents = []string{events.PeerCreated, events.PeerFirstHandshake, events.PeerStateChanged, events.PeerDeleted, events.PeerRemoved}
+
+// KeyRotationConfig describes where a new server key is served until it
+// replaces the previous one.
+type KeyRotationConfig struct {
+	OverlapInterface  string `json:"overlap_interface"`
+	OverlapListenPort int    `json:"overlap_listen_port"`
+	// OverlapEndpoint is the public endpoint of OverlapListenPort; it
+	// defaults to the interface endpoint's host with that port.
+	OverlapEndpoint    string `json:"overlap_endpoint"`
+	GracePeriodSeconds int    `json:"grace_period_seconds"`
+}
+
+// Supported log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logLevels maps the log_level setting to slog levels. "release" is the
+// former name of the info level.
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"release": slog.LevelInfo,
+	"warn":    slog.LevelWarn,
+	"error":   slog.LevelError,
+}
+
+// Supported WireGuard backends.
+const (
+	BackendKernel    = "kernel"
+	BackendUserspace = "userspace"
+)
+
+// InterfaceConfig describes one WireGuard interface served by the gateway.
+type InterfaceConfig struct {
+	Name                       string             `json:"name"`
+	Backend                    string             `json:"backend"`
+	UserspaceTUN               bool               `json:"userspace_tun"`
+	Endpoint                   string             `json:"endpoint"`
+	AddressPool                string             `json:"address_pool"`
+	PersistentKeepaliveSeconds *int               `json:"persistent_keepalive_seconds"`
+	BatchWindowMillis          int                `json:"batch_window_ms"`
+	ClientAllowedIPs           []string           `json:"client_allowed_ips"`
+	ClientDNS                  []string           `json:"client_dns"`
+	JSONTemplatePath           string             `json:"json_template_path"`
+	Bootstrap                  BootstrapConfig    `json:"bootstrap"`
+	KeyRotation                *KeyRotationConfig `json:"key_rotation"`
+}
+
+// Config holds runtime configuration loaded from a JSON file.
+type Config struct {
+	ListenAddr                 string             `json:"listen_addr"`
+	WGInterface                string             `json:"wg_interface"`
+	WGEndpoint                 string             `json:"wg_endpoint"`
+	WGBootstrap                BootstrapConfig    `json:"wg_bootstrap"`
+	WGBackend                  string             `json:"wg_backend"`
+	WGUserspaceTUN             bool               `json:"wg_userspace_tun"`
+	WGKeyRotation              *KeyRotationConfig `json:"wg_key_rotation"`
+	Interfaces                 []InterfaceConfig  `json:"interfaces"`
+	PersistentKeepaliveSeconds int                `json:"persistent_keepalive_seconds"`
+	BatchWindowMillis          int                `json:"batch_window_ms"`
+	ClientAllowedIPs           []string           `json:"client_allowed_ips"`
+	ClientDNS                  []string           `json:"client_dns"`
+	JSONTemplatePath           string             `json:"json_template_path"`
+	TemplateDir                string             `json:"template_dir"`
+	TemplateEnv                []string           `json:"template_env"`
+	WatchTemplates             *bool              `json:"watch_templates"`
+	TemplateFallback           *bool              `json:"template_fallback"`
+	TrustProxyLoopbackOnly     *bool              `json:"trust_proxy_loopback_only"`
+	LogLevel                   string             `json:"log_level"`
+	LogFormat                  string             `json:"log_format"`
+	Tracing                    TracingConfig      `json:"tracing"`
+	Audit                      AuditConfig        `json:"audit"`
+	Webhooks                   WebhooksConfig     `json:"webhooks"`
+	UsePresharedKey            bool               `json:"use_preshared_key"`
+	GCDryRun                   bool               `json:"gc_dry_run"`
+	Auth                       AuthConfig         `json:"auth"`
+}
+
+func loadConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("open config: %w", err)
+	}
+	defer file.Close()
+
+	var cfg Config
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("decode config: %w", err)
+	}
+
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":8080"
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if _, ok := logLevels[cfg.LogLevel]; !ok {
+		return Config{}, fmt.Errorf("unknown log_level %q", cfg.LogLevel)
+	}
+	switch cfg.LogFormat {
+	case "":
+		cfg.LogFormat = LogFormatText
+	case LogFormatText, LogFormatJSON:
+	default:
+		return Config{}, fmt.Errorf("unknown log_format %q", cfg.LogFormat)
+	}
+	if cfg.Audit.MaxSizeMB == nil {
+		maxSize := defaultAuditMaxSizeMB
+		cfg.Audit.MaxSizeMB = &maxSize
+	}
+	if cfg.Audit.MaxBackups == nil {
+		maxBackups := defaultAuditMaxBackups
+		cfg.Audit.MaxBackups = &maxBackups
+	}
+	if *cfg.Audit.MaxSizeMB < 0 || *cfg.Audit.MaxBackups < 0 {
+		return Config{}, errors.New("audit max_size_mb and max_backups must not be negative")
+	}
+	if len(cfg.Webhooks.Targets) > 0 && cfg.Webhooks.OutboxDir == "" {
+		return Config{}, errors.New("webhooks: outbox_dir is required")
+	}
+	if cfg.Webhooks.MaxAttempts < 0 {
+		return Config{}, errors.New("webhooks: max_attempts must not be negative")
+	}
+	webhookURLs := make(map[string]bool, len(cfg.Webhooks.Targets))
+	for i, target := range cfg.Webhooks.Targets {
+		if target.URL == "" {
+			return Config{}, fmt.Errorf("webhooks.targets[%d]: url is required", i)
+		}
+		if webhookURLs[target.URL] {
+			return Config{}, fmt.Errorf("webhooks.targets[%d]: duplicate url %s", i, target.URL)
+		}
+		webhookURLs[target.URL] = true
+		for _, event := range target.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return Config{}, fmt.Errorf("webhooks.targets[%d]: unknown event %q", i, event)
+			}
+		}
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = "wireguard-gateway"
+	}
+
+	// A configuration without an interface list describes a single
+	// interface through the top-level wg_* settings.
+	if len(cfg.Interfaces) == 0 {
+		if cfg.WGInterface == "" {
+			return Config{}, errors.New("wg_interface is required")
+		}
+		if cfg.WGEndpoint == "" {
+			return Config{}, errors.New("wg_endpoint is required")
+		}
+		cfg.Interfaces = []InterfaceConfig{{
+			Name:         cfg.WGInterface,
+			Backend:      cfg.WGBackend,
+			UserspaceTUN: cfg.WGUserspaceTUN,
+			Endpoint:     cfg.WGEndpoint,
+			Bootstrap:    cfg.WGBootstrap,
+			KeyRotation:  cfg.WGKeyRotation,
+		}}
+	} else if cfg.WGInterface != "" || cfg.WGEndpoint != "" || cfg.WGBackend != "" || cfg.WGUserspaceTUN || cfg.WGBootstrap.Enabled || cfg.WGKeyRotation != nil {
+		return Config{}, errors.New("wg_interface, wg_endpoint, wg_backend, wg_userspace_tun, wg_bootstrap and wg_key_rotation cannot be combined with interfaces")
+	}
+
+	seen := make(map[string]bool, len(cfg.Interfaces))
+	for i := range cfg.Interfaces {
+		iface := &cfg.Interfaces[i]
+		if iface.Name == "" {
+			return Config{}, fmt.Errorf("interfaces[%d]: name is required", i)
+		}
+		if seen[iface.Name] {
+			return Config{}, fmt.Errorf("interfaces[%d]: duplicate name %s", i, iface.Name)
+		}
+		seen[iface.Name] = true
+		if iface.Endpoint == "" {
+			return Config{}, fmt.Errorf("interface %s: endpoint is required", iface.Name)
+		}
+		switch iface.Backend {
+		case "":
+			iface.Backend = BackendKernel
+		case BackendKernel, BackendUserspace:
+		default:
+			return Config{}, fmt.Errorf("interface %s: unknown backend %q", iface.Name, iface.Backend)
+		}
+		if iface.Backend == BackendUserspace {
+			// A userspace device starts empty, so it is always bootstrapped.
+			iface.Bootstrap.Enabled = true
+		}
+		// An explicit 0 turns keepalive off even when the top-level value
+		// enables it.
+		if iface.PersistentKeepaliveSeconds == nil {
+			keepalive := cfg.PersistentKeepaliveSeconds
+			iface.PersistentKeepaliveSeconds = &keepalive
+		}
+		if *iface.PersistentKeepaliveSeconds < 0 {
+			return Config{}, fmt.Errorf("interface %s: persistent_keepalive_seconds must not be negative", iface.Name)
+		}
+		if len(iface.ClientAllowedIPs) == 0 {
+			iface.ClientAllowedIPs = cfg.ClientAllowedIPs
+		}
+		if len(iface.ClientDNS) == 0 {
+			iface.ClientDNS = cfg.ClientDNS
+		}
+		if iface.BatchWindowMillis == 0 {
+			iface.BatchWindowMillis = cfg.BatchWindowMillis
+		}
+		if iface.BatchWindowMillis < 0 {
+			return Config{}, fmt.Errorf("interface %s: batch_window_ms must not be negative", iface.Name)
+		}
+		if iface.JSONTemplatePath == "" {
+			iface.JSONTemplatePath = cfg.JSONTemplatePath
+		}
+		if iface.Bootstrap.ListenPort < 0 || iface.Bootstrap.ListenPort > 65535 {
+			return Config{}, fmt.Errorf("interface %s: bootstrap listen_port must be between 0 and 65535", iface.Name)
+		}
+		if rot := iface.KeyRotation; rot != nil {
+			if rot.OverlapInterface == "" || seen[rot.OverlapInterface] {
+				return Config{}, fmt.Errorf("interface %s: key_rotation overlap_interface must name an unused interface", iface.Name)
+			}
+			seen[rot.OverlapInterface] = true
+			if rot.OverlapListenPort <= 0 || rot.OverlapListenPort > 65535 {
+				return Config{}, fmt.Errorf("interface %s: key_rotation overlap_listen_port must be between 1 and 65535", iface.Name)
+			}
+			if rot.OverlapListenPort == iface.Bootstrap.ListenPort {
+				return Config{}, fmt.Errorf("interface %s: key_rotation overlap_listen_port must differ from the bootstrap listen_port", iface.Name)
+			}
+			if rot.OverlapEndpoint == "" {
+				host, _, err := net.SplitHostPort(iface.Endpoint)
+				if err != nil {
+					return Config{}, fmt.Errorf("interface %s: key_rotation overlap_endpoint is required when endpoint has no port: %w", iface.Name, err)
+				}
+				rot.OverlapEndpoint = net.JoinHostPort(host, strconv.Itoa(rot.OverlapListenPort))
+			} else if _, _, err := net.SplitHostPort(rot.OverlapEndpoint); err != nil {
+				return Config{}, fmt.Errorf("interface %s: key_rotation overlap_endpoint: %w", iface.Name, err)
+			}
+			if rot.GracePeriodSeconds < 0 {
+				return Config{}, fmt.Errorf("interface %s: key_rotation grace_period_seconds must not be negative", iface.Name)
+			}
+			if rot.GracePeriodSeconds == 0 {
+				rot.GracePeriodSeconds = 3600
+			}
+		}
+	}
+
+	if cfg.Auth.Basic.Username == "" || cfg.Auth.Basic.Password == "" {
+		return Config{}, errors.New("basic auth credentials are required")
+	}
+	if cfg.Auth.JWT.Secret == "" {
+		return Config{}, errors.New("jwt secret is required")
+	}
+
+	return cfg, nil
+}
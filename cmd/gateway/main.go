@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,113 +16,214 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/events"
 	"github.com/example/wireguard-gateway/internal/gc"
+	"github.com/example/wireguard-gateway/internal/ipam"
 	"github.com/example/wireguard-gateway/internal/peers"
 	"github.com/example/wireguard-gateway/internal/server"
 	templater "github.com/example/wireguard-gateway/internal/template"
+	"github.com/example/wireguard-gateway/internal/webhook"
 	"github.com/example/wireguard-gateway/internal/wg"
 )
 
-// AuthConfig holds authentication settings.
-type AuthConfig struct {
-	Basic BasicAuthConfig `json:"basic"`
-	JWT   JWTConfig       `json:"jwt"`
-}
-
-// BasicAuthConfig describes HTTP basic authentication credentials.
-type BasicAuthConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
+// templateWatchInterval is how often template files are checked for changes.
+const templateWatchInterval = 2 * time.Second
 
-// JWTConfig describes JWT validation settings.
-type JWTConfig struct {
-	Secret string `json:"secret"`
-}
-
-// Config holds runtime configuration loaded from a JSON file.
-type Config struct {
-	ListenAddr                 string     `json:"listen_addr"`
-	WGInterface                string     `json:"wg_interface"`
-	WGEndpoint                 string     `json:"wg_endpoint"`
-	PersistentKeepaliveSeconds int        `json:"persistent_keepalive_seconds"`
-	JSONTemplatePath           string     `json:"json_template_path"`
-	TrustProxyLoopbackOnly     *bool      `json:"trust_proxy_loopback_only"`
-	LogLevel                   string     `json:"log_level"`
-	UsePresharedKey            bool       `json:"use_preshared_key"`
-	Auth                       AuthConfig `json:"auth"`
-}
+func main() {
+	configPath := flag.String("config", "config.json", "path to configuration file")
+	flag.Parse()
 
-func loadConfig(path string) (Config, error) {
-	file, err := os.Open(path)
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
-		return Config{}, fmt.Errorf("open config: %w", err)
+		fatal("failed to load configuration", "error", err)
 	}
-	defer file.Close()
 
-	var cfg Config
-	decoder := json.NewDecoder(file)
-	decoder.DisallowUnknownFields()
-	if err := decoder.Decode(&cfg); err != nil {
-		return Config{}, fmt.Errorf("decode config: %w", err)
+	logger := newLogger(cfg)
+	slog.SetDefault(logger)
+	if cfg.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
 	}
 
-	if cfg.ListenAddr == "" {
-		cfg.ListenAddr = ":8080"
-	}
-	if cfg.LogLevel == "" {
-		cfg.LogLevel = "info"
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("tracing shutdown failed", "error", err)
+		}
+	}()
 
-	if cfg.WGInterface == "" {
-		return Config{}, errors.New("wg_interface is required")
+	templateOpts := templater.Options{
+		Sample: server.SampleTemplateData(),
+		Env:    cfg.TemplateEnv,
 	}
-	if cfg.WGEndpoint == "" {
-		return Config{}, errors.New("wg_endpoint is required")
-	}
-	if cfg.JSONTemplatePath == "" {
-		return Config{}, errors.New("json_template_path is required")
-	}
-	if cfg.Auth.Basic.Username == "" || cfg.Auth.Basic.Password == "" {
-		return Config{}, errors.New("basic auth credentials are required")
+	defaultRenderer, err := templater.NewDefaultRenderer(templateOpts)
+	if err != nil {
+		fatal("failed to load embedded template", "error", err)
 	}
-	if cfg.Auth.JWT.Secret == "" {
-		return Config{}, errors.New("jwt secret is required")
+	if cfg.TemplateFallback == nil || *cfg.TemplateFallback {
+		templateOpts.Fallback = defaultRenderer
 	}
 
-	return cfg, nil
-}
+	// renderers holds the templates loaded from disk, by path.
+	renderers := make(map[string]*templater.Renderer)
+	interfaces := make([]server.Interface, 0, len(cfg.Interfaces))
+	managers := make([]gc.Manager, 0, len(cfg.Interfaces))
+	for _, ifaceCfg := range cfg.Interfaces {
+		renderer, ok := renderers[ifaceCfg.JSONTemplatePath]
+		if ifaceCfg.JSONTemplatePath == "" {
+			renderer = defaultRenderer
+		} else if !ok {
+			renderer, err = templater.NewJSONRenderer(ifaceCfg.JSONTemplatePath, templateOpts)
+			if err != nil {
+				fatal("failed to load template", "interface", ifaceCfg.Name, "error", err)
+			}
+			renderers[ifaceCfg.JSONTemplatePath] = renderer
+		}
 
-func main() {
-	configPath := flag.String("config", "config.json", "path to configuration file")
-	flag.Parse()
+		wgManager, err := newManager(ifaceCfg)
+		if err != nil {
+			fatal("failed to create wireguard manager", "interface", ifaceCfg.Name, "error", err)
+		}
+		defer wgManager.Close()
+		wgManager.EnableBatching(time.Duration(ifaceCfg.BatchWindowMillis) * time.Millisecond)
 
-	cfg, err := loadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("failed to load configuration: %v", err)
-	}
+		if ifaceCfg.Bootstrap.Enabled {
+			if err := wgManager.Bootstrap(wg.InterfaceConfig{
+				PrivateKeyPath: ifaceCfg.Bootstrap.PrivateKeyPath,
+				ListenPort:     ifaceCfg.Bootstrap.ListenPort,
+				FirewallMark:   ifaceCfg.Bootstrap.FirewallMark,
+				Address:        ifaceCfg.Bootstrap.Address,
+				MTU:            ifaceCfg.Bootstrap.MTU,
+			}); err != nil {
+				fatal("wireguard interface bootstrap failed", "interface", ifaceCfg.Name, "error", err)
+			}
+			if ifaceCfg.Bootstrap.TeardownOnExit {
+				defer func() {
+					if err := wgManager.Teardown(); err != nil {
+						logger.Error("wireguard interface teardown failed", "interface", wgManager.Interface(), "error", err)
+					}
+				}()
+			}
+		}
 
-	if cfg.LogLevel == "release" {
-		gin.SetMode(gin.ReleaseMode)
+		if err := wgManager.VerifyInterface(); err != nil {
+			fatal("wireguard interface check failed", "interface", ifaceCfg.Name, "error", err)
+		}
+
+		pool, err := newPool(ifaceCfg)
+		if err != nil {
+			fatal("wireguard interface address pool", "interface", ifaceCfg.Name, "error", err)
+		}
+
+		iface := server.Interface{
+			Name:                       ifaceCfg.Name,
+			Endpoint:                   ifaceCfg.Endpoint,
+			Renderer:                   renderer,
+			Manager:                    wgManager,
+			Pool:                       pool,
+			ClientAllowedIPs:           ifaceCfg.ClientAllowedIPs,
+			ClientDNS:                  ifaceCfg.ClientDNS,
+			PersistentKeepaliveSeconds: *ifaceCfg.PersistentKeepaliveSeconds,
+		}
+		var manager gc.Manager = wgManager
+		if ifaceCfg.KeyRotation != nil {
+			// Peers may live on the overlap interface during a rotation, so
+			// peer operations go through the rotator.
+			rotator := newKeyRotator(wgManager, ifaceCfg)
+			defer rotator.Close()
+			iface.Manager = rotator
+			iface.Rotator = rotator
+			iface.OverlapEndpoint = ifaceCfg.KeyRotation.OverlapEndpoint
+			iface.OverlapListenPort = ifaceCfg.KeyRotation.OverlapListenPort
+			manager = rotator
+		}
+		managers = append(managers, manager)
+		interfaces = append(interfaces, iface)
 	}
 
-	renderer, err := templater.NewRenderer(cfg.JSONTemplatePath)
-	if err != nil {
-		log.Fatalf("failed to load template: %v", err)
+	var templates *templater.Set
+	if cfg.TemplateDir != "" {
+		templates, err = templater.NewSet(cfg.TemplateDir, templateOpts)
+		if err != nil {
+			fatal("failed to load templates", "dir", cfg.TemplateDir, "error", err)
+		}
 	}
 
-	wgManager, err := wg.NewManager(cfg.WGInterface, cfg.PersistentKeepaliveSeconds)
-	if err != nil {
-		log.Fatalf("failed to create wireguard manager: %v", err)
+	var auditLog *audit.Log
+	if cfg.Audit.Path != "" {
+		auditLog, err = audit.Open(audit.Options{
+			Path:       cfg.Audit.Path,
+			MaxSize:    int64(*cfg.Audit.MaxSizeMB) << 20,
+			MaxBackups: *cfg.Audit.MaxBackups,
+			HashChain:  cfg.Audit.HashChain,
+		})
+		if err != nil {
+			fatal("failed to open audit log", "error", err)
+		}
+		defer auditLog.Close()
 	}
-	defer wgManager.Close()
 
-	if err := wgManager.VerifyInterface(); err != nil {
-		log.Fatalf("wireguard interface check failed: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	bus := events.NewBus()
+	stopWebhooks := func() {}
+	if len(cfg.Webhooks.Targets) > 0 {
+		targets := make([]webhook.Target, 0, len(cfg.Webhooks.Targets))
+		for _, target := range cfg.Webhooks.Targets {
+			targets = append(targets, webhook.Target{URL: target.URL, Secret: target.Secret, Events: target.Events})
+		}
+		dispatcher, err := webhook.New(webhook.Options{
+			Targets:     targets,
+			OutboxDir:   cfg.Webhooks.OutboxDir,
+			MaxAttempts: cfg.Webhooks.MaxAttempts,
+			Logger:      logger,
+		})
+		if err != nil {
+			fatal("failed to set up webhooks", "error", err)
+		}
+		bus.Handle(dispatcher.Publish)
+		// The dispatcher outlives the server, so that events of requests
+		// finished during shutdown still reach the outbox.
+		webhookCtx, cancelWebhooks := context.WithCancel(context.Background())
+		webhooksDone := make(chan struct{})
+		go func() {
+			dispatcher.Run(webhookCtx)
+			close(webhooksDone)
+		}()
+		stopWebhooks = func() {
+			cancelWebhooks()
+			<-webhooksDone
+		}
 	}
 
 	peerStore := peers.NewStore()
 
+	gcRunners := make([]*gc.GC, 0, len(interfaces))
+	for i := range interfaces {
+		iface := &interfaces[i]
+		gcRunner := gc.New(gc.Options{
+			Interval:          time.Minute,
+			Store:             peerStore,
+			Manager:           managers[i],
+			Interface:         iface.Name,
+			Pool:              iface.Pool,
+			Logger:            logger,
+			Audit:             auditLog,
+			Events:            bus,
+			NeverConnectedTTL: 10 * time.Minute,
+			StaleHandshakeTTL: 24 * time.Hour,
+			DryRun:            cfg.GCDryRun,
+		})
+		iface.Collector = gcRunner
+		gcRunners = append(gcRunners, gcRunner)
+	}
+
 	trustProxy := true
 	if cfg.TrustProxyLoopbackOnly != nil {
 		trustProxy = *cfg.TrustProxyLoopbackOnly
@@ -129,35 +231,37 @@ func main() {
 
 	srv, err := server.New(server.Options{
 		ListenAddr:             cfg.ListenAddr,
-		Interface:              cfg.WGInterface,
-		Endpoint:               cfg.WGEndpoint,
 		TrustProxyLoopbackOnly: trustProxy,
-		Renderer:               renderer,
+		Interfaces:             interfaces,
+		Templates:              templates,
+		TemplateEnv:            cfg.TemplateEnv,
+		Logger:                 logger,
+		Audit:                  auditLog,
+		Events:                 bus,
 		PeerStore:              peerStore,
-		Manager:                wgManager,
 		UsePresharedKey:        cfg.UsePresharedKey,
 		BasicAuthUsername:      cfg.Auth.Basic.Username,
 		BasicAuthPassword:      cfg.Auth.Basic.Password,
 		JWTSecret:              cfg.Auth.JWT.Secret,
 	})
 	if err != nil {
-		log.Fatalf("failed to initialize server: %v", err)
+		fatal("failed to initialize server", "error", err)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
-
-	gcRunner := gc.New(gc.Options{
-		Interval:          time.Minute,
-		Store:             peerStore,
-		Manager:           wgManager,
-		Interface:         cfg.WGInterface,
-		Logger:            log.Default(),
-		NeverConnectedTTL: 10 * time.Minute,
-		StaleHandshakeTTL: 24 * time.Hour,
-	})
+	if cfg.WatchTemplates == nil || *cfg.WatchTemplates {
+		onReload := func(err error) { auditTemplateReload(auditLog, err) }
+		for _, renderer := range renderers {
+			go renderer.Watch(ctx, templateWatchInterval, onReload)
+		}
+		if templates != nil {
+			go templates.Watch(ctx, templateWatchInterval, onReload)
+		}
+	}
+	go reloadOnHangup(ctx, renderers, templates, auditLog)
 
-	go gcRunner.Run(ctx)
+	for _, gcRunner := range gcRunners {
+		go gcRunner.Run(ctx)
+	}
 
 	serverErr := make(chan error, 1)
 	go func() {
@@ -166,10 +270,10 @@ func main() {
 
 	select {
 	case <-ctx.Done():
-		log.Println("shutdown signal received")
+		logger.Info("shutdown signal received")
 	case err := <-serverErr:
 		if err != nil && err != http.ErrServerClosed {
-			log.Printf("server error: %v", err)
+			logger.Error("server error", "error", err)
 		}
 	}
 
@@ -177,8 +281,160 @@ func main() {
 	defer cancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		log.Printf("graceful shutdown failed: %v", err)
+		logger.Error("graceful shutdown failed", "error", err)
+	}
+	stopWebhooks()
+
+	logger.Info("gateway stopped")
+}
+
+// newLogger builds the process logger from the log_level and log_format
+// settings.
+func newLogger(cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevels[cfg.LogLevel]}
+	if cfg.LogFormat == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// fatal logs an error and exits. Deferred cleanup does not run.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// reloadOnHangup reloads every template when the process receives SIGHUP
+// and records the outcome in the audit log.
+func reloadOnHangup(ctx context.Context, renderers map[string]*templater.Renderer, templates *templater.Set, auditLog *audit.Log) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			var errs []error
+			for _, renderer := range renderers {
+				// Reload logs and counts its own outcome.
+				errs = append(errs, renderer.Reload())
+			}
+			if templates != nil {
+				errs = append(errs, templates.Reload())
+			}
+			auditTemplateReload(auditLog, errors.Join(errs...))
+		}
 	}
+}
+
+// auditTemplateReload records a template reload not requested through the
+// API, with its error if it failed.
+func auditTemplateReload(auditLog *audit.Log, err error) {
+	event := audit.Event{Action: audit.ActionTemplateReloaded, Actor: audit.ActorSystem}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	if err := auditLog.Record(event); err != nil {
+		slog.Error("record audit event", "action", event.Action, "error", err)
+	}
+}
 
-	log.Println("gateway stopped")
+// newManager creates the manager for an interface on its configured backend.
+func newManager(cfg InterfaceConfig) (*wg.Manager, error) {
+	if cfg.Backend != BackendUserspace {
+		return wg.NewManager(cfg.Name, *cfg.PersistentKeepaliveSeconds)
+	}
+
+	var addresses []netip.Addr
+	if cfg.Bootstrap.Address != "" {
+		prefix, err := netip.ParsePrefix(cfg.Bootstrap.Address)
+		if err != nil {
+			return nil, fmt.Errorf("parse bootstrap address: %w", err)
+		}
+		addresses = append(addresses, prefix.Addr())
+	}
+	device, err := wg.NewUserspaceDevice(wg.UserspaceConfig{
+		Name:      cfg.Name,
+		Addresses: addresses,
+		MTU:       cfg.Bootstrap.MTU,
+		TUN:       cfg.UserspaceTUN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wg.NewManagerWithClient(device, cfg.Name, *cfg.PersistentKeepaliveSeconds), nil
+}
+
+// newKeyRotator configures server key rotation for an interface. The
+// overlap interface uses the same backend as the interface it shadows.
+func newKeyRotator(m *wg.Manager, cfg InterfaceConfig) *wg.KeyRotator {
+	rot := cfg.KeyRotation
+	// The overlap interface carries the interface's address as a host
+	// address, so that it does not compete for the prefix route; moved
+	// peers are routed through it individually.
+	overlapCfg := InterfaceConfig{
+		Name:                       rot.OverlapInterface,
+		Backend:                    cfg.Backend,
+		UserspaceTUN:               cfg.UserspaceTUN,
+		PersistentKeepaliveSeconds: cfg.PersistentKeepaliveSeconds,
+		Bootstrap: BootstrapConfig{
+			Address: hostAddress(cfg.Bootstrap.Address),
+			MTU:     cfg.Bootstrap.MTU,
+		},
+	}
+	return wg.NewKeyRotator(m, wg.RotationConfig{
+		OverlapInterface:  rot.OverlapInterface,
+		OverlapListenPort: rot.OverlapListenPort,
+		Grace:             time.Duration(rot.GracePeriodSeconds) * time.Second,
+		PrivateKeyPath:    cfg.Bootstrap.PrivateKeyPath,
+		NewOverlap: func() (*wg.Manager, error) {
+			overlap, err := newManager(overlapCfg)
+			if err != nil {
+				return nil, err
+			}
+			if err := overlap.Bootstrap(wg.InterfaceConfig{
+				Address: overlapCfg.Bootstrap.Address,
+				MTU:     overlapCfg.Bootstrap.MTU,
+			}); err != nil {
+				overlap.Teardown()
+				overlap.Close()
+				return nil, err
+			}
+			return overlap, nil
+		},
+	})
+}
+
+// hostAddress narrows an address in CIDR notation to a single-address
+// prefix. Invalid input is returned unchanged.
+func hostAddress(address string) string {
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return address
+	}
+	return netip.PrefixFrom(prefix.Addr(), prefix.Addr().BitLen()).String()
+}
+
+// newPool builds the interface's address pool, reserving the server's own
+// address when it falls inside the pool.
+func newPool(cfg InterfaceConfig) (*ipam.Pool, error) {
+	if cfg.AddressPool == "" {
+		return nil, nil
+	}
+	pool, err := ipam.NewPool(cfg.AddressPool)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Bootstrap.Address != "" {
+		ip, _, err := net.ParseCIDR(cfg.Bootstrap.Address)
+		if err != nil {
+			return nil, fmt.Errorf("parse bootstrap address: %w", err)
+		}
+		if err := pool.Reserve(ip); err != nil && !errors.Is(err, ipam.ErrOutOfRange) {
+			return nil, err
+		}
+	}
+	return pool, nil
 }
@@ -0,0 +1,477 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionPeerCreated      = "peer.created"
+	ActionPeerDeleted      = "peer.deleted"
+	ActionPeerRemoved      = "peer.removed"
+	ActionPeerKeyRotated   = "peer.key_rotated"
+	ActionServerKeyRotated = "interface.key_rotated"
+	ActionTemplateReloaded = "template.reloaded"
+	ActionAuthFailed       = "auth.failed"
+)
+
+// Actors for events not caused by an authenticated caller.
+const (
+	ActorAdmin  = "admin"
+	ActorSystem = "system"
+)
+
+// ErrTampered indicates that the hash chain of the log does not verify.
+var ErrTampered = errors.New("audit log hash chain broken")
+
+// ErrCorrupt indicates a line of the log that is not a valid entry.
+var ErrCorrupt = errors.New("audit log entry corrupt")
+
+// ErrNoHashChain indicates that Verify was called on a log without a hash
+// chain.
+var ErrNoHashChain = errors.New("audit log is not hash-chained")
+
+// rotatedSuffix formats the timestamp appended to rotated files. It sorts
+// in chronological order.
+const rotatedSuffix = "20060102T150405.000000000Z"
+
+// Event is one audit log entry.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Actor is the JWT subject of the caller, ActorAdmin for basic
+	// credentials or ActorSystem for background work.
+	Actor     string `json:"actor,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	PeerID    string `json:"peer_id,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// PrevHash and Hash chain the entries together when hash chaining is
+	// enabled.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Options configures an audit log.
+type Options struct {
+	// Path is the file events are appended to.
+	Path string
+	// MaxSize rotates the file once it would grow beyond this many bytes.
+	// Zero disables rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept. Zero keeps them all.
+	MaxBackups int
+	// HashChain stores in every entry the SHA-256 of the previous entry
+	// and of itself, so that edits and deletions can be detected.
+	HashChain bool
+}
+
+// Filter selects events in Query. Zero fields match everything.
+type Filter struct {
+	Action    string
+	Actor     string
+	PeerID    string
+	Interface string
+	Since     time.Time
+	Until     time.Time
+	// Limit returns only the most recent matching events.
+	Limit int
+}
+
+// Log is an append-only JSON lines audit log.
+type Log struct {
+	mu       sync.Mutex
+	opts     Options
+	file     *os.File
+	size     int64
+	lastHash string
+	nowFunc  func() time.Time
+}
+
+// Open opens the log at opts.Path, creating it if needed. A hash chain
+// continues from the last entry already in the log.
+func Open(opts Options) (*Log, error) {
+	if opts.Path == "" {
+		return nil, errors.New("audit log path is required")
+	}
+	l := &Log{opts: opts, nowFunc: time.Now}
+	if err := truncatePartialLine(opts.Path); err != nil {
+		return nil, fmt.Errorf("repair audit log: %w", err)
+	}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	if opts.HashChain {
+		files, err := l.files()
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		for i := len(files) - 1; i >= 0 && l.lastHash == ""; i-- {
+			last, err := lastEvent(files[i])
+			if err != nil {
+				l.file.Close()
+				return nil, err
+			}
+			if last != nil {
+				l.lastHash = last.Hash
+			}
+		}
+	}
+	return l, nil
+}
+
+// Record appends an event. The time is set when it is zero. Record on a
+// nil Log does nothing.
+func (l *Log) Record(event Event) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = l.nowFunc()
+	}
+	event.Time = event.Time.UTC()
+	event.PrevHash, event.Hash = "", ""
+	if l.opts.HashChain {
+		event.PrevHash = l.lastHash
+		hash, err := eventHash(event)
+		if err != nil {
+			return err
+		}
+		event.Hash = hash
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	if err != nil {
+		// Drop a partly written line so the next entry starts on a line of
+		// its own. Should that fail too, Open drops it.
+		if n > 0 && l.file.Truncate(l.size) != nil {
+			l.size += int64(n)
+		}
+		return err
+	}
+	l.size += int64(n)
+	l.lastHash = event.Hash
+	return nil
+}
+
+// Query returns the matching events in the order they were recorded.
+// Lines that are not valid entries are skipped; Verify reports them.
+func (l *Log) Query(filter Filter) ([]Event, error) {
+	files, err := l.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(files)
+
+	var events []Event
+	for _, f := range files {
+		err := f.read(func(_ int, event Event) error {
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events, nil
+}
+
+// Verify checks the hash chain across the current and the rotated files.
+// Entries removed by MaxBackups leave the oldest remaining entry pointing
+// at a hash that is no longer present, which is accepted. Lines that are
+// not valid entries are reported together with ErrCorrupt, and the chain
+// is checked again from the entry after each of them.
+func (l *Log) Verify() error {
+	if !l.opts.HashChain {
+		return ErrNoHashChain
+	}
+	files, err := l.snapshot()
+	if err != nil {
+		return err
+	}
+	defer closeAll(files)
+
+	var corrupt []error
+	prev, first := "", true
+	for _, f := range files {
+		err := f.read(func(line int, event Event) error {
+			if !first && event.PrevHash != prev {
+				return fmt.Errorf("%w: %s:%d does not follow the previous entry", ErrTampered, f.path, line)
+			}
+			hash, err := eventHash(event)
+			if err != nil {
+				return err
+			}
+			if hash != event.Hash {
+				return fmt.Errorf("%w: %s:%d was modified", ErrTampered, f.path, line)
+			}
+			prev, first = event.Hash, false
+			return nil
+		}, func(line int, err error) {
+			corrupt = append(corrupt, fmt.Errorf("%w: %s:%d: %w", ErrCorrupt, f.path, line, err))
+			first = true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(corrupt...)
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *Log) openFile() error {
+	file, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the current file aside under a timestamped name, starts a
+// new one and drops the oldest rotated files beyond MaxBackups.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	rotated := l.opts.Path + "." + l.nowFunc().UTC().Format(rotatedSuffix)
+	if err := os.Rename(l.opts.Path, rotated); err != nil {
+		return err
+	}
+	if err := l.openFile(); err != nil {
+		return err
+	}
+	if l.opts.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups lists the rotated files, oldest first.
+func (l *Log) backups() ([]string, error) {
+	matches, err := filepath.Glob(l.opts.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := matches[:0]
+	prefix := len(l.opts.Path) + 1
+	for _, path := range matches {
+		if _, err := time.Parse(rotatedSuffix, path[prefix:]); err == nil {
+			backups = append(backups, path)
+		}
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// files lists the rotated files followed by the current one.
+func (l *Log) files() ([]string, error) {
+	backups, err := l.backups()
+	if err != nil {
+		return nil, err
+	}
+	return append(backups, l.opts.Path), nil
+}
+
+func (f Filter) matches(event Event) bool {
+	switch {
+	case f.Action != "" && event.Action != f.Action,
+		f.Actor != "" && event.Actor != f.Actor,
+		f.PeerID != "" && event.PeerID != f.PeerID,
+		f.Interface != "" && event.Interface != f.Interface,
+		!f.Since.IsZero() && event.Time.Before(f.Since),
+		!f.Until.IsZero() && !event.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// eventHash returns the hex SHA-256 of the event's JSON encoding without
+// its own hash. The encoding includes PrevHash, which chains the entries.
+func eventHash(event Event) (string, error) {
+	event.Hash = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// logFile is a file of the log opened for reading. Only the first size
+// bytes are read, so that an entry being appended is not seen half-way.
+type logFile struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// snapshot opens the rotated files and the current one. Only opening them
+// holds the lock; reading them afterwards does not hold up Record, and
+// rotations meanwhile do not affect the open files.
+func (l *Log) snapshot() ([]logFile, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]logFile, 0, len(paths))
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			closeAll(files)
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			closeAll(files)
+			return nil, err
+		}
+		files = append(files, logFile{path: path, file: file, size: info.Size()})
+	}
+	return files, nil
+}
+
+func closeAll(files []logFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// read calls fn for every entry with its line number. Lines that do not
+// parse are passed to corrupt, or skipped when it is nil.
+func (f logFile) read(fn func(line int, event Event) error, corrupt func(line int, err error)) error {
+	return readEvents(io.LimitReader(f.file, f.size), fn, corrupt)
+}
+
+func readEvents(r io.Reader, fn func(line int, event Event) error, corrupt func(line int, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			if corrupt != nil {
+				corrupt(line, err)
+			}
+			continue
+		}
+		if err := fn(line, event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// lastEvent returns the last valid entry of a file, or nil when it has
+// none.
+func lastEvent(path string) (*Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last *Event
+	err = readEvents(file, func(_ int, event Event) error {
+		last = &event
+		return nil
+	}, nil)
+	return last, err
+}
+
+// truncatePartialLine cuts a file that does not end in a newline back to
+// its last complete line. Such a line is left behind by a crash while it
+// was being written. A missing file is fine.
+func truncatePartialLine(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	buf := make([]byte, 64*1024)
+	for offset := end; offset > 0; {
+		n := int64(len(buf))
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if keep := offset + int64(i) + 1; keep < end {
+				return file.Truncate(keep)
+			}
+			return nil
+		}
+	}
+	return file.Truncate(0)
+}
@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, opts Options) *Log {
+	t.Helper()
+	if opts.Path == "" {
+		opts.Path = filepath.Join(t.TempDir(), "audit.jsonl")
+	}
+	l, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRecordAndQuery(t *testing.T) {
+	l := openTestLog(t, Options{})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: start, Action: ActionPeerCreated, Actor: "alice", PeerID: "p1", Interface: "wg0"},
+		{Time: start.Add(time.Hour), Action: ActionPeerCreated, Actor: "bob", PeerID: "p2", Interface: "wg1"},
+		{Time: start.Add(2 * time.Hour), Action: ActionPeerDeleted, Actor: ActorAdmin, PeerID: "p1", Interface: "wg0"},
+	}
+	for _, event := range events {
+		if err := l.Record(event); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{name: "all", want: []string{"p1", "p2", "p1"}},
+		{name: "action", filter: Filter{Action: ActionPeerCreated}, want: []string{"p1", "p2"}},
+		{name: "actor", filter: Filter{Actor: "bob"}, want: []string{"p2"}},
+		{name: "peer", filter: Filter{PeerID: "p1"}, want: []string{"p1", "p1"}},
+		{name: "interface", filter: Filter{Interface: "wg1"}, want: []string{"p2"}},
+		{name: "range", filter: Filter{Since: start.Add(time.Hour), Until: start.Add(2 * time.Hour)}, want: []string{"p2"}},
+		{name: "limit", filter: Filter{Limit: 1}, want: []string{"p1"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := l.Query(tc.filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			var ids []string
+			for _, event := range got {
+				ids = append(ids, event.PeerID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("expected %v, got %v", tc.want, ids)
+			}
+		})
+	}
+
+	last, _ := l.Query(Filter{Limit: 1})
+	if last[0].Action != ActionPeerDeleted || last[0].Hash != "" {
+		t.Fatalf("unexpected last event %+v", last[0])
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := openTestLog(t, Options{Path: path, MaxSize: 200, MaxBackups: 2})
+	for i := 0; i < 10; i++ {
+		if err := l.Record(Event{Action: ActionAuthFailed, Reason: strings.Repeat("x", 100)}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", backups)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 200 {
+		t.Fatalf("expected current file within max size, got %v, %v", info, err)
+	}
+	events, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected the events of three files, got %d", len(events))
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := openTestLog(t, Options{Path: path, MaxSize: 400, HashChain: true})
+	for _, id := range []string{"p1", "p2", "p3"} {
+		if err := l.Record(Event{Action: ActionPeerCreated, PeerID: id}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	l.Close()
+
+	// Reopening continues the chain.
+	l = openTestLog(t, Options{Path: path, MaxSize: 400, HashChain: true})
+	if err := l.Record(Event{Action: ActionPeerDeleted, PeerID: "p1"}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if err := l.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	events, _ := l.Query(Filter{})
+	for i := 1; i < len(events); i++ {
+		if events[i].PrevHash != events[i-1].Hash || events[i].Hash == "" {
+			t.Fatalf("event %d is not chained: %+v", i, events[i])
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(string(data), `"p1"`, `"p9"`, 1)), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := l.Verify(); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered, got %v", err)
+	}
+}
+
+func TestVerifyWithoutHashChain(t *testing.T) {
+	l := openTestLog(t, Options{})
+	if err := l.Verify(); !errors.Is(err, ErrNoHashChain) {
+		t.Fatalf("expected ErrNoHashChain, got %v", err)
+	}
+}
+
+func TestOpenDropsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := openTestLog(t, Options{Path: path, HashChain: true})
+	if err := l.Record(Event{Action: ActionPeerCreated, PeerID: "p1"}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	l.Close()
+
+	// A crash in the middle of a write leaves a partial line behind.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := file.WriteString(`{"time":"2024-01-01T00:00:00Z","act`); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	file.Close()
+
+	l = openTestLog(t, Options{Path: path, HashChain: true})
+	if err := l.Record(Event{Action: ActionPeerCreated, PeerID: "p2"}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	events, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != 2 || events[1].PeerID != "p2" {
+		t.Fatalf("expected both entries, got %+v", events)
+	}
+	if err := l.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+func TestCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := openTestLog(t, Options{Path: path, HashChain: true})
+	for _, id := range []string{"p1", "p2", "p3"} {
+		if err := l.Record(Event{Action: ActionPeerCreated, PeerID: id}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines[1] = "not json\n"
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// A corrupt line does not stop the log from opening or being queried.
+	l = openTestLog(t, Options{Path: path, HashChain: true})
+	if err := l.Record(Event{Action: ActionPeerDeleted, PeerID: "p1"}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	events, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected the valid entries, got %+v", events)
+	}
+	err = l.Verify()
+	if !errors.Is(err, ErrCorrupt) || errors.Is(err, ErrTampered) || !strings.Contains(err.Error(), "audit.jsonl:2") {
+		t.Fatalf("expected ErrCorrupt for line 2, got %v", err)
+	}
+}
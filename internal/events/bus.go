@@ -0,0 +1,118 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Peer lifecycle event types.
+const (
+	PeerCreated        = "peer.created"
+	PeerFirstHandshake = "peer.first_handshake"
+	PeerStateChanged   = "peer.state_changed"
+	PeerDeleted        = "peer.deleted"
+	PeerRemoved        = "peer.removed"
+)
+
+// Event describes a change to a peer.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	PeerID    string    `json:"peer_id"`
+	Interface string    `json:"interface"`
+	Owner     string    `json:"owner,omitempty"`
+	// State is the new connection state of a peer.state_changed event.
+	State string `json:"state,omitempty"`
+	// Reason explains why the garbage collector removed a peer.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Bus fans events out to the registered handlers and subscribers.
+type Bus struct {
+	mu          sync.RWMutex
+	handlers    []func(Event)
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events published on a Bus.
+type Subscription struct {
+	// C receives the published events. It is closed by Close.
+	C <-chan Event
+
+	bus     *Bus
+	ch      chan Event
+	dropped atomic.Int64
+	once    sync.Once
+}
+
+// NewBus constructs a bus without handlers.
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Handle registers fn to be called with every published event. Handlers
+// run synchronously in the publisher's goroutine and must not block.
+func (b *Bus) Handle(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, fn)
+}
+
+// Subscribe returns a subscription that receives published events.
+// Events are dropped for a subscriber whose buffer is full, so that a slow
+// reader never holds up the publisher; Dropped reports how many.
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, bus: b, ch: ch}
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Dropped returns the number of events dropped since the previous call.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// Close ends the subscription and closes C. It is safe to call more than
+// once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subscribers, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Publish assigns the event an ID and, when unset, the current time and
+// passes it to every handler and subscriber. Publish on a nil Bus does
+// nothing.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	event.ID = uuid.NewString()
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.handlers {
+		fn(event)
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
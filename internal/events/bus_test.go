@@ -0,0 +1,35 @@
+package events
+
+import "testing"
+
+func TestSubscribe(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(1)
+
+	bus.Publish(Event{Type: PeerCreated, PeerID: "p1"})
+	// The buffer is full, so this event is dropped for the subscriber.
+	bus.Publish(Event{Type: PeerDeleted, PeerID: "p1"})
+
+	event := <-sub.C
+	if event.Type != PeerCreated || event.ID == "" || event.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	select {
+	case event := <-sub.C:
+		t.Fatalf("expected the second event dropped, got %+v", event)
+	default:
+	}
+	if n := sub.Dropped(); n != 1 {
+		t.Fatalf("expected one dropped event, got %d", n)
+	}
+	if n := sub.Dropped(); n != 0 {
+		t.Fatalf("expected the dropped count reset, got %d", n)
+	}
+
+	sub.Close()
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatalf("expected the channel closed")
+	}
+	bus.Publish(Event{Type: PeerCreated})
+}
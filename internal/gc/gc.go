@@ -2,42 +2,118 @@ package gc
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/events"
+	"github.com/example/wireguard-gateway/internal/ipam"
 	"github.com/example/wireguard-gateway/internal/peers"
+	"github.com/example/wireguard-gateway/internal/wg"
 )
 
 // Manager provides the subset of WireGuard operations needed for GC.
 type Manager interface {
-	Handshakes() (map[string]time.Time, error)
-	RemovePeer(publicKey wgtypes.Key) error
+	PeerStats() (map[string]wg.PeerStats, error)
+	RemovePeers(publicKeys []wgtypes.Key) error
 }
 
 // Options configures the garbage collector.
 type Options struct {
-	Interval          time.Duration
-	Store             *peers.Store
-	Manager           Manager
-	Interface         string
-	Logger            *log.Logger
+	Interval  time.Duration
+	Store     *peers.Store
+	Manager   Manager
+	Interface string
+	// Pool receives the addresses of removed peers when the interface
+	// assigns them from a pool.
+	Pool              *ipam.Pool
+	Logger            *slog.Logger
 	NeverConnectedTTL time.Duration
 	StaleHandshakeTTL time.Duration
+	// IdleAfter and StaleAfter are how long after the last handshake a
+	// connected peer becomes idle and then stale; they default to three
+	// minutes and one hour. Stale peers are removed only once
+	// StaleHandshakeTTL has passed.
+	IdleAfter  time.Duration
+	StaleAfter time.Duration
+	// DryRun logs and reports the peers a cycle would remove without
+	// removing them.
+	DryRun bool
+	// Audit records every removal. It may be nil.
+	Audit *audit.Log
+	// Events receives first handshakes, state changes and removals. It may
+	// be nil.
+	Events *events.Bus
+}
+
+const (
+	// defaultIdleAfter exceeds the two minutes after which WireGuard
+	// renews the session of a peer that is sending traffic.
+	defaultIdleAfter  = 3 * time.Minute
+	defaultStaleAfter = time.Hour
+)
+
+// Reasons a peer is removed for.
+const (
+	ReasonNeverConnected = "never_connected"
+	ReasonStaleHandshake = "stale_handshake"
+)
+
+// expiredPeer is a peer selected for removal.
+type expiredPeer struct {
+	peer   *peers.Peer
+	reason string
+}
+
+// Removal is a peer removed by a cycle or, in a dry run, selected for
+// removal.
+type Removal struct {
+	PeerID          string     `json:"peer_id"`
+	Interface       string     `json:"interface"`
+	Owner           string     `json:"owner,omitempty"`
+	Reason          string     `json:"reason"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastHandshakeAt *time.Time `json:"last_handshake_at"`
+}
+
+func newRemoval(e expiredPeer) Removal {
+	return Removal{
+		PeerID:          e.peer.ID,
+		Interface:       e.peer.Interface,
+		Owner:           e.peer.Owner,
+		Reason:          e.reason,
+		CreatedAt:       e.peer.CreatedAt,
+		LastHandshakeAt: e.peer.LastHandshakeAt,
+	}
 }
 
 // GC periodically removes stale peers.
 type GC struct {
 	opts    Options
 	nowFunc func() time.Time
+	// mu serializes cycles, which may also be triggered on demand.
+	mu sync.Mutex
 }
 
 // New constructs a GC runner.
 func New(opts Options) *GC {
 	if opts.Logger == nil {
-		opts.Logger = log.Default()
+		opts.Logger = slog.Default()
 	}
+	if opts.IdleAfter == 0 {
+		opts.IdleAfter = defaultIdleAfter
+	}
+	if opts.StaleAfter == 0 {
+		opts.StaleAfter = defaultStaleAfter
+	}
+	opts.Logger = opts.Logger.With("component", "gc", "interface", opts.Interface)
 	return &GC{opts: opts, nowFunc: time.Now}
 }
 
@@ -51,63 +127,306 @@ func (g *GC) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			g.runOnce()
+			// Failures are logged by the cycle and retried by the next.
+			_, _ = g.RunOnce(ctx, audit.ActorSystem)
 		}
 	}
 }
 
-func (g *GC) runOnce() {
-	handshakes, err := g.opts.Manager.Handshakes()
-	if err != nil {
-		g.opts.Logger.Printf("gc: handshakes: %v", err)
-		handshakes = map[string]time.Time{}
+// DryRun reports whether cycles only report what they would remove.
+func (g *GC) DryRun() bool {
+	return g.opts.DryRun
+}
+
+// RunOnce performs a single collection cycle and returns the peers it
+// removed, or would remove in dry-run mode. Removals are audited as actor.
+// The error reports a failed device read or update; the peers a failed
+// update covered are kept for the next cycle. The cycle's spans are
+// children of ctx.
+func (g *GC) RunOnce(ctx context.Context, actor string) ([]Removal, error) {
+	return g.cycle(ctx, g.opts.DryRun, actor)
+}
+
+// DryRunOnce performs a collection cycle that only reports what it would
+// remove. Connection states are still updated.
+func (g *GC) DryRunOnce(ctx context.Context) ([]Removal, error) {
+	return g.cycle(ctx, true, "")
+}
+
+func (g *GC) cycle(ctx context.Context, dryRun bool, actor string) ([]Removal, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ctx, span := tracer.Start(ctx, "gc.cycle")
+	defer span.End()
+
+	var stats map[string]wg.PeerStats
+	statsErr := traced(ctx, "wg.PeerStats", func() (err error) {
+		stats, err = g.opts.Manager.PeerStats()
+		return err
+	})
+	if statsErr != nil {
+		g.opts.Logger.Error("read peer stats", "error", statsErr)
+		statsErr = fmt.Errorf("read peer stats: %w", statsErr)
+		stats = map[string]wg.PeerStats{}
 	}
 
 	peersList := g.opts.Store.List()
 	now := g.nowFunc()
+	var retiredErr error
+	if !dryRun {
+		retiredErr = g.expireRetiredKeys(ctx, peersList, now)
+	}
 
+	var expired []expiredPeer
 	for _, p := range peersList {
-		if t, ok := handshakes[p.PublicKey]; ok && !t.IsZero() {
-			if err := g.opts.Store.UpdateHandshake(p.ID, t); err != nil {
-				g.opts.Logger.Printf("gc: update handshake for %s: %v", p.ID, err)
-			} else {
-				p.LastHandshakeAt = &t
-			}
+		if g.opts.Interface != "" && p.Interface != g.opts.Interface {
+			continue
 		}
 
+		g.track(p, stats[p.PublicKey], now)
+
 		if p.LastHandshakeAt == nil {
 			if g.opts.NeverConnectedTTL > 0 && now.Sub(p.CreatedAt) > g.opts.NeverConnectedTTL {
-				g.removePeer(p)
+				expired = append(expired, expiredPeer{p, ReasonNeverConnected})
 			}
 			continue
 		}
 
 		if g.opts.StaleHandshakeTTL > 0 && now.Sub(*p.LastHandshakeAt) > g.opts.StaleHandshakeTTL {
-			g.removePeer(p)
+			expired = append(expired, expiredPeer{p, ReasonStaleHandshake})
 		}
 	}
-}
 
-func (g *GC) removePeer(p *peers.Peer) {
-	removed, err := g.opts.Store.Delete(p.ID)
-	if err != nil {
-		if err == peers.ErrNotFound {
-			return
+	if dryRun {
+		removals := make([]Removal, 0, len(expired))
+		for _, e := range expired {
+			g.opts.Logger.Info("would remove inactive peer", "peer_id", e.peer.ID, "reason", e.reason, "dry_run", true)
+			removals = append(removals, newRemoval(e))
 		}
-		g.opts.Logger.Printf("gc: delete store peer %s: %v", p.ID, err)
-		return
+		return removals, statsErr
 	}
+	removals, err := g.removePeers(ctx, expired, actor)
+	return removals, errors.Join(statsErr, retiredErr, err)
+}
 
-	key, err := wgtypes.ParseKey(removed.PublicKey)
+// track records a peer's handshake, endpoint and connection state and
+// publishes its first handshake and state changes. p is updated in place.
+func (g *GC) track(p *peers.Peer, stats wg.PeerStats, now time.Time) {
+	last := stats.LastHandshake
+	if last.IsZero() && p.LastHandshakeAt != nil {
+		last = *p.LastHandshakeAt
+	}
+	conn := peers.Connection{
+		LastHandshakeAt: stats.LastHandshake,
+		Endpoint:        stats.Endpoint,
+		State:           g.state(last, now),
+	}
+	prev, err := g.opts.Store.UpdateConnection(p.ID, conn, now)
 	if err != nil {
-		g.opts.Logger.Printf("gc: parse public key for %s: %v", p.ID, err)
+		g.opts.Logger.Error("update connection", "peer_id", p.ID, "error", err)
 		return
 	}
+	if !last.IsZero() {
+		p.LastHandshakeAt = &last
+	}
+
+	event := events.Event{PeerID: p.ID, Interface: p.Interface, Owner: p.Owner}
+	if prev.FirstConnectedAt == nil && !stats.LastHandshake.IsZero() {
+		event.Type, event.Time = events.PeerFirstHandshake, stats.LastHandshake
+		g.opts.Events.Publish(event)
+	}
+	if prev.State != conn.State {
+		g.opts.Logger.Debug("peer state changed", "peer_id", p.ID, "from", prev.State, "to", conn.State)
+		event.Type, event.Time, event.State = events.PeerStateChanged, now, string(conn.State)
+		g.opts.Events.Publish(event)
+	}
+}
+
+// state derives the connection state from the last handshake, which is
+// zero when there was none.
+func (g *GC) state(last, now time.Time) peers.State {
+	switch age := now.Sub(last); {
+	case last.IsZero():
+		return peers.StatePending
+	case age <= g.opts.IdleAfter:
+		return peers.StateConnected
+	case age <= g.opts.StaleAfter:
+		return peers.StateIdle
+	default:
+		return peers.StateStale
+	}
+}
+
+// removePeers removes expired peers from the device in a single update and
+// then deletes them from the store. Peers stay in the store when the device
+// update fails, so a later cycle retries them. It returns the peers removed
+// from both; removals are audited as actor. The peers stay locked
+// throughout, so that no key rotation installs a key for a peer being
+// removed.
+func (g *GC) removePeers(ctx context.Context, expired []expiredPeer, actor string) ([]Removal, error) {
+	candidates := make([]expiredPeer, 0, len(expired))
+	keys := make([]wgtypes.Key, 0, len(expired))
+	for _, e := range expired {
+		unlock := g.opts.Store.Lock(e.peer.ID)
+		defer unlock()
+		// The peer may have been deleted or given new keys since it was
+		// listed.
+		peer, err := g.opts.Store.Get(e.peer.ID)
+		if err != nil {
+			continue
+		}
+		// Retired keys still in their overlap go with the peer.
+		peerKeys, err := parseKeys(peer.PublicKeys())
+		if err != nil {
+			g.opts.Logger.Error("parse public key", "peer_id", peer.ID, "error", err)
+			continue
+		}
+		candidates = append(candidates, expiredPeer{peer, e.reason})
+		keys = append(keys, peerKeys...)
+	}
+	if len(keys) == 0 {
+		return []Removal{}, nil
+	}
+
+	if err := traced(ctx, "wg.RemovePeers", func() error { return g.opts.Manager.RemovePeers(keys) }); err != nil {
+		g.opts.Logger.Error("remove peers", "count", len(keys), "error", err)
+		return []Removal{}, fmt.Errorf("remove peers: %w", err)
+	}
+
+	removed := make([]expiredPeer, 0, len(candidates))
+	for _, e := range candidates {
+		peer, err := g.opts.Store.Delete(e.peer.ID)
+		if err != nil {
+			// A peer deleted concurrently has already been released.
+			if !errors.Is(err, peers.ErrNotFound) {
+				g.opts.Logger.Error("delete store peer", "peer_id", e.peer.ID, "error", err)
+			}
+			continue
+		}
+		removed = append(removed, expiredPeer{peer, e.reason})
+	}
+
+	removals := make([]Removal, 0, len(removed))
+	for _, e := range removed {
+		peer := e.peer
+		for _, cidr := range peer.AllowedCIDRs() {
+			g.release(peer.ID, cidr)
+		}
+		g.opts.Logger.Info("removed inactive peer", "peer_id", peer.ID, "reason", e.reason)
+		if err := g.opts.Audit.Record(audit.Event{
+			Action:    audit.ActionPeerRemoved,
+			Actor:     actor,
+			PeerID:    peer.ID,
+			Interface: peer.Interface,
+			Reason:    e.reason,
+		}); err != nil {
+			g.opts.Logger.Error("record audit event", "peer_id", peer.ID, "error", err)
+		}
+		g.opts.Events.Publish(events.Event{
+			Type:      events.PeerRemoved,
+			PeerID:    peer.ID,
+			Interface: peer.Interface,
+			Owner:     peer.Owner,
+			Reason:    e.reason,
+		})
+		removals = append(removals, newRemoval(e))
+	}
+	return removals, nil
+}
 
-	if err := g.opts.Manager.RemovePeer(key); err != nil {
-		g.opts.Logger.Printf("gc: remove peer %s: %v", p.ID, err)
+// expireRetiredKeys removes the retired keys whose overlap has ended at
+// now from the device in a single update
+// and then from the store, and releases their addresses. The peers are
+// updated in place and stay locked throughout. The keys stay when the
+// device update fails.
+func (g *GC) expireRetiredKeys(ctx context.Context, list []*peers.Peer, now time.Time) error {
+	type dueKey struct {
+		peer    *peers.Peer
+		retired peers.RetiredKey
+	}
+	var due []dueKey
+	var keys []wgtypes.Key
+	for _, p := range list {
+		if g.opts.Interface != "" && p.Interface != g.opts.Interface {
+			continue
+		}
+		if !slices.ContainsFunc(p.RetiredKeys, func(retired peers.RetiredKey) bool {
+			return !retired.Until.After(now)
+		}) {
+			continue
+		}
+		unlock := g.opts.Store.Lock(p.ID)
+		defer unlock()
+		// A rotation or deletion since the peer was listed may have
+		// changed its retired keys.
+		current, err := g.opts.Store.Get(p.ID)
+		if err != nil {
+			continue
+		}
+		p.RetiredKeys = current.RetiredKeys
+		for _, retired := range p.RetiredKeys {
+			if retired.Until.After(now) {
+				continue
+			}
+			key, err := wgtypes.ParseKey(retired.PublicKey)
+			if err != nil {
+				g.opts.Logger.Error("parse retired key", "peer_id", p.ID, "error", err)
+				continue
+			}
+			due = append(due, dueKey{p, retired})
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := traced(ctx, "wg.RemovePeers", func() error { return g.opts.Manager.RemovePeers(keys) }); err != nil {
+		g.opts.Logger.Error("remove retired keys", "count", len(keys), "error", err)
+		return fmt.Errorf("remove retired keys: %w", err)
+	}
+	for _, d := range due {
+		err := g.opts.Store.RemoveRetiredKeys(d.peer.ID, []string{d.retired.PublicKey})
+		if err != nil {
+			// A peer deleted concurrently has already been released.
+			if !errors.Is(err, peers.ErrNotFound) {
+				g.opts.Logger.Error("forget retired key", "peer_id", d.peer.ID, "error", err)
+			}
+			continue
+		}
+		d.peer.RetiredKeys = slices.DeleteFunc(slices.Clone(d.peer.RetiredKeys), func(retired peers.RetiredKey) bool {
+			return retired.PublicKey == d.retired.PublicKey
+		})
+		g.release(d.peer.ID, d.retired.AllowedCIDR)
+		g.opts.Logger.Info("removed retired key", "peer_id", d.peer.ID)
+	}
+	return nil
+}
+
+// release returns a peer address to the pool, if the interface has one.
+func (g *GC) release(peerID, cidr string) {
+	if g.opts.Pool == nil {
 		return
 	}
+	ip, _, err := net.ParseCIDR(cidr)
+	if err == nil {
+		err = g.opts.Pool.Release(ip)
+	}
+	if err != nil {
+		g.opts.Logger.Error("release address", "peer_id", peerID, "error", err)
+	}
+}
 
-	g.opts.Logger.Printf("gc: removed peer %s due to inactivity", p.ID)
+// parseKeys parses public keys in their string form.
+func parseKeys(publicKeys []string) ([]wgtypes.Key, error) {
+	keys := make([]wgtypes.Key, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
@@ -1,43 +1,52 @@
 package gc
 
 import (
+	"context"
 	"errors"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/events"
 	"github.com/example/wireguard-gateway/internal/peers"
+	"github.com/example/wireguard-gateway/internal/wg"
 )
 
-type fakeManager struct {
-	handshakes map[string]time.Time
-	removed    []wgtypes.Key
-}
-
-func (f *fakeManager) Handshakes() (map[string]time.Time, error) {
-	return f.handshakes, nil
-}
-
-func (f *fakeManager) RemovePeer(key wgtypes.Key) error {
-	f.removed = append(f.removed, key)
-	return nil
-}
-
-func TestGCRemovesNeverConnectedPeer(t *testing.T) {
-	store := peers.NewStore()
+// addPeer registers a fresh peer on both the store and the fake device.
+func addPeer(t *testing.T, store *peers.Store, mgr *wg.Manager, peer *peers.Peer) wgtypes.Key {
+	t.Helper()
 	priv, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		t.Fatalf("generate private key: %v", err)
 	}
-	peer := &peers.Peer{
-		ID:        "peer-1",
-		PublicKey: priv.PublicKey().String(),
-		CreatedAt: time.Unix(0, 0),
+	pub := priv.PublicKey()
+	allowed, err := wg.AllowedIPNet(net.IPv4(192, 0, 2, byte(len(store.List())+1)))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
 	}
+	if err := mgr.AddPeer(pub, nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	peer.PublicKey = pub.String()
 	store.Add(peer)
+	return pub
+}
 
-	mgr := &fakeManager{handshakes: map[string]time.Time{}}
+func TestGCRemovesNeverConnectedPeer(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	pub := addPeer(t, store, mgr, &peers.Peer{
+		ID:        "peer-1",
+		CreatedAt: time.Unix(0, 0),
+	})
 
 	g := New(Options{
 		Interval:          time.Minute,
@@ -48,34 +57,29 @@ func TestGCRemovesNeverConnectedPeer(t *testing.T) {
 	})
 	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
 
-	g.runOnce()
+	g.RunOnce(context.Background(), audit.ActorSystem)
 
 	if _, err := store.Get("peer-1"); !errors.Is(err, peers.ErrNotFound) {
 		t.Fatalf("expected peer removed, got err %v", err)
 	}
-	if len(mgr.removed) != 1 {
-		t.Fatalf("expected 1 removed peer, got %d", len(mgr.removed))
+	if _, ok := device.Peer(pub); ok {
+		t.Fatalf("expected peer removed from device")
 	}
 }
 
 func TestGCRemovesStaleHandshakePeer(t *testing.T) {
 	store := peers.NewStore()
-	priv, err := wgtypes.GeneratePrivateKey()
-	if err != nil {
-		t.Fatalf("generate private key: %v", err)
-	}
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
 	handshake := time.Unix(0, 0)
-	peer := &peers.Peer{
+	pub := addPeer(t, store, mgr, &peers.Peer{
 		ID:              "peer-2",
-		PublicKey:       priv.PublicKey().String(),
 		CreatedAt:       time.Unix(0, 0),
 		LastHandshakeAt: &handshake,
+	})
+	if err := device.Handshake(pub, handshake, nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
 	}
-	store.Add(peer)
-
-	mgr := &fakeManager{handshakes: map[string]time.Time{
-		priv.PublicKey().String(): handshake,
-	}}
 
 	g := New(Options{
 		Interval:          time.Minute,
@@ -86,12 +90,465 @@ func TestGCRemovesStaleHandshakePeer(t *testing.T) {
 	})
 	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(25 * time.Hour) }
 
-	g.runOnce()
+	g.RunOnce(context.Background(), audit.ActorSystem)
 
 	if _, err := store.Get("peer-2"); !errors.Is(err, peers.ErrNotFound) {
 		t.Fatalf("expected peer removed, got err %v", err)
 	}
-	if len(mgr.removed) != 1 {
-		t.Fatalf("expected 1 removed peer, got %d", len(mgr.removed))
+	if _, ok := device.Peer(pub); ok {
+		t.Fatalf("expected peer removed from device")
+	}
+}
+
+func TestGCIgnoresPeersOnOtherInterfaces(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	addPeer(t, store, mgr, &peers.Peer{
+		ID:        "peer-3",
+		Interface: "wg1",
+		CreatedAt: time.Unix(0, 0),
+	})
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: 10 * time.Minute,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	g.RunOnce(context.Background(), audit.ActorSystem)
+
+	if _, err := store.Get("peer-3"); err != nil {
+		t.Fatalf("expected peer on other interface kept, got err %v", err)
+	}
+	if got := len(device.Peers()); got != 1 {
+		t.Fatalf("expected device peer kept, got %d peers", got)
+	}
+}
+
+func TestGCRemovesExpiredPeersInOneUpdate(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	for _, id := range []string{"peer-a", "peer-b", "peer-c"} {
+		addPeer(t, store, mgr, &peers.Peer{ID: id, CreatedAt: time.Unix(0, 0)})
+	}
+	before := len(device.Configs())
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		NeverConnectedTTL: 10 * time.Minute,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	g.RunOnce(context.Background(), audit.ActorSystem)
+
+	if got := len(device.Peers()); got != 0 {
+		t.Fatalf("expected all peers removed, got %d", got)
+	}
+	if got := len(device.Configs()) - before; got != 1 {
+		t.Fatalf("expected a single device update, got %d", got)
+	}
+}
+
+func TestGCKeepsPeersWhenDeviceUpdateFails(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	pub := addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", CreatedAt: time.Unix(0, 0)})
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		NeverConnectedTTL: 10 * time.Minute,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	injected := errors.New("netlink busy")
+	device.FailNext(wg.FakeOpConfigure, injected)
+	if removals, err := g.RunOnce(context.Background(), audit.ActorSystem); len(removals) != 0 || !errors.Is(err, injected) {
+		t.Fatalf("expected no removals and the device error, got %+v %v", removals, err)
+	}
+	if _, err := store.Get("peer-1"); err != nil {
+		t.Fatalf("expected peer to remain in store: %v", err)
+	}
+	if _, ok := device.Peer(pub); !ok {
+		t.Fatalf("expected peer to remain on device")
+	}
+
+	// The next cycle retries the removal.
+	if removals, err := g.RunOnce(context.Background(), audit.ActorSystem); len(removals) != 1 || err != nil {
+		t.Fatalf("expected one removal, got %+v %v", removals, err)
+	}
+	if _, err := store.Get("peer-1"); !errors.Is(err, peers.ErrNotFound) {
+		t.Fatalf("expected peer removed, got err %v", err)
+	}
+}
+
+func TestGCWaitsForPeerLock(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	oldKey := addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", CreatedAt: time.Unix(0, 0)})
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		NeverConnectedTTL: 10 * time.Minute,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	// A key rotation holds the peer while the cycle selects it.
+	unlock := store.Lock("peer-1")
+	done := make(chan []Removal)
+	go func() {
+		removals, _ := g.RunOnce(context.Background(), audit.ActorSystem)
+		done <- removals
+	}()
+	select {
+	case <-done:
+		t.Fatalf("expected the cycle to wait for the peer lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate private key: %v", err)
+	}
+	newKey := priv.PublicKey()
+	allowed, err := wg.AllowedIPNet(net.IPv4(192, 0, 2, 1))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := mgr.ReplacePeer(oldKey, newKey, nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("ReplacePeer: %v", err)
+	}
+	if err := store.UpdateKeys("peer-1", newKey.String(), "", ""); err != nil {
+		t.Fatalf("UpdateKeys: %v", err)
+	}
+	unlock()
+
+	if removals := <-done; len(removals) != 1 {
+		t.Fatalf("expected one removal, got %+v", removals)
+	}
+	if _, ok := device.Peer(newKey); ok {
+		t.Fatalf("expected the rotated key removed, not left behind")
+	}
+}
+
+func TestGCExpiresRetiredKeys(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	start := time.Unix(0, 0)
+	handshake := start
+	addPeer(t, store, mgr, &peers.Peer{
+		ID:              "peer-1",
+		CreatedAt:       start,
+		LastHandshakeAt: &handshake,
+	})
+	retire := func(until time.Time) wgtypes.Key {
+		t.Helper()
+		priv, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("generate private key: %v", err)
+		}
+		key := priv.PublicKey()
+		allowed, err := wg.AllowedIPNet(net.IPv4(192, 0, 2, 2))
+		if err != nil {
+			t.Fatalf("allowed ip: %v", err)
+		}
+		if err := mgr.AddPeer(key, nil, []net.IPNet{allowed}); err != nil {
+			t.Fatalf("AddPeer: %v", err)
+		}
+		if err := store.AddRetiredKey("peer-1", peers.RetiredKey{PublicKey: key.String(), AllowedCIDR: "192.0.2.2/32", Until: until}); err != nil {
+			t.Fatalf("AddRetiredKey: %v", err)
+		}
+		return key
+	}
+	retired := retire(start.Add(time.Minute))
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		NeverConnectedTTL: time.Hour,
+		StaleHandshakeTTL: time.Hour,
+	})
+	g.nowFunc = func() time.Time { return start.Add(30 * time.Second) }
+	g.RunOnce(context.Background(), audit.ActorSystem)
+	if _, ok := device.Peer(retired); !ok {
+		t.Fatalf("expected retired key kept during its overlap")
+	}
+
+	g.nowFunc = func() time.Time { return start.Add(2 * time.Minute) }
+	g.RunOnce(context.Background(), audit.ActorSystem)
+	if _, ok := device.Peer(retired); ok {
+		t.Fatalf("expected retired key removed from device after its overlap")
+	}
+	peer, err := store.Get("peer-1")
+	if err != nil {
+		t.Fatalf("expected peer kept, got err %v", err)
+	}
+	if len(peer.RetiredKeys) != 0 {
+		t.Fatalf("expected retired key forgotten, got %+v", peer.RetiredKeys)
+	}
+}
+
+func TestGCTracesDeviceCalls(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", CreatedAt: time.Unix(0, 0)})
+
+	g := New(Options{Interval: time.Minute, Store: store, Manager: mgr, NeverConnectedTTL: time.Minute})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(time.Hour) }
+	g.RunOnce(context.Background(), audit.ActorSystem)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	cycle, ok := spans["gc.cycle"]
+	if !ok {
+		t.Fatalf("expected gc.cycle span, got %v", spans)
+	}
+	for _, name := range []string{"wg.PeerStats", "wg.RemovePeers"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected %s span", name)
+		}
+		if span.Parent().SpanID() != cycle.SpanContext().SpanID() {
+			t.Fatalf("expected %s to be a child of gc.cycle", name)
+		}
+	}
+}
+
+func TestGCRecordsRemovals(t *testing.T) {
+	store := peers.NewStore()
+	mgr := wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0)
+	addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", Interface: "wg0", CreatedAt: time.Unix(0, 0)})
+
+	auditLog, err := audit.Open(audit.Options{Path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil {
+		t.Fatalf("audit.Open: %v", err)
+	}
+	defer auditLog.Close()
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: 10 * time.Minute,
+		Audit:             auditLog,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	g.RunOnce(context.Background(), audit.ActorAdmin)
+
+	events, err := auditLog.Query(audit.Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one audit event, got %+v", events)
+	}
+	event := events[0]
+	if event.Action != audit.ActionPeerRemoved || event.PeerID != "peer-1" || event.Reason != ReasonNeverConnected || event.Actor != audit.ActorAdmin {
+		t.Fatalf("unexpected audit event %+v", event)
+	}
+}
+
+func TestGCPublishesFirstHandshake(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	pub := addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", Interface: "wg0", Owner: "alice", CreatedAt: time.Unix(0, 0)})
+
+	bus := events.NewBus()
+	var published []events.Event
+	bus.Handle(func(event events.Event) { published = append(published, event) })
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: 10 * time.Minute,
+		Events:            bus,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(time.Minute) }
+
+	handshake := time.Unix(30, 0)
+	if err := device.Handshake(pub, handshake, nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	g.RunOnce(context.Background(), audit.ActorSystem)
+	if err := device.Handshake(pub, handshake.Add(time.Second), nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	g.RunOnce(context.Background(), audit.ActorSystem)
+
+	if len(published) != 2 {
+		t.Fatalf("expected two events, got %+v", published)
+	}
+	event := published[0]
+	if event.Type != events.PeerFirstHandshake || event.PeerID != "peer-1" || event.Owner != "alice" || !event.Time.Equal(handshake) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event := published[1]; event.Type != events.PeerStateChanged || event.State != string(peers.StateConnected) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestGCTracksConnectionState(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	created := time.Unix(0, 0)
+	pub := addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", Interface: "wg0", CreatedAt: created})
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		StaleHandshakeTTL: 24 * time.Hour,
+	})
+	now := created
+	g.nowFunc = func() time.Time { return now }
+
+	check := func(state peers.State, changedAt time.Time) *peers.Peer {
+		t.Helper()
+		g.RunOnce(context.Background(), audit.ActorSystem)
+		peer, err := store.Get("peer-1")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if peer.State != state || !peer.StateChangedAt.Equal(changedAt) {
+			t.Fatalf("expected %s since %s, got %s since %s", state, changedAt, peer.State, peer.StateChangedAt)
+		}
+		return peer
+	}
+
+	check(peers.StatePending, created)
+
+	handshake := created.Add(time.Minute)
+	endpoint := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 40000}
+	if err := device.Handshake(pub, handshake, endpoint); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	now = handshake.Add(time.Minute)
+	peer := check(peers.StateConnected, now)
+	if peer.FirstConnectedAt == nil || !peer.FirstConnectedAt.Equal(handshake) || peer.Endpoint != "198.51.100.7:40000" {
+		t.Fatalf("expected first connection and endpoint recorded, got %+v", peer)
+	}
+
+	now = handshake.Add(10 * time.Minute)
+	check(peers.StateIdle, now)
+
+	later := handshake.Add(5 * time.Minute)
+	if err := device.Handshake(pub, later, nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	now = later.Add(time.Minute)
+	peer = check(peers.StateConnected, now)
+	if !peer.FirstConnectedAt.Equal(handshake) || !peer.LastHandshakeAt.Equal(later) {
+		t.Fatalf("expected first connection kept and last handshake updated, got %+v", peer)
+	}
+
+	now = later.Add(2 * time.Hour)
+	check(peers.StateStale, now)
+}
+
+func TestGCDryRun(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	pub := addPeer(t, store, mgr, &peers.Peer{ID: "peer-1", Interface: "wg0", Owner: "alice", CreatedAt: time.Unix(0, 0)})
+	// A retired key whose overlap has ended stays put in a dry run too.
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate private key: %v", err)
+	}
+	retired := priv.PublicKey()
+	allowed, err := wg.AllowedIPNet(net.IPv4(192, 0, 2, 9))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := mgr.AddPeer(retired, nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if err := store.AddRetiredKey("peer-1", peers.RetiredKey{PublicKey: retired.String(), AllowedCIDR: "192.0.2.9/32", Until: time.Unix(0, 0)}); err != nil {
+		t.Fatalf("AddRetiredKey: %v", err)
+	}
+	checkRetiredKept := func() {
+		t.Helper()
+		if _, ok := device.Peer(retired); !ok {
+			t.Fatalf("expected retired key kept on device in dry run")
+		}
+		if peer, _ := store.Get("peer-1"); len(peer.RetiredKeys) != 1 {
+			t.Fatalf("expected retired key kept in store in dry run, got %+v", peer.RetiredKeys)
+		}
+	}
+
+	g := New(Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: 10 * time.Minute,
+		DryRun:            true,
+	})
+	g.nowFunc = func() time.Time { return time.Unix(0, 0).Add(11 * time.Minute) }
+
+	removals, err := g.RunOnce(context.Background(), audit.ActorSystem)
+	if err != nil || len(removals) != 1 {
+		t.Fatalf("expected one removal, got %+v", removals)
+	}
+	removal := removals[0]
+	if removal.PeerID != "peer-1" || removal.Owner != "alice" || removal.Reason != ReasonNeverConnected {
+		t.Fatalf("unexpected removal %+v", removal)
+	}
+	if _, err := store.Get("peer-1"); err != nil {
+		t.Fatalf("expected peer kept in dry run: %v", err)
+	}
+	if _, ok := device.Peer(pub); !ok {
+		t.Fatalf("expected peer kept on device in dry run")
+	}
+	checkRetiredKept()
+
+	g.opts.DryRun = false
+	if removals, err := g.DryRunOnce(context.Background()); err != nil || len(removals) != 1 {
+		t.Fatalf("expected one removal from DryRunOnce, got %+v %v", removals, err)
+	}
+	if _, err := store.Get("peer-1"); err != nil {
+		t.Fatalf("expected peer kept by DryRunOnce: %v", err)
+	}
+	checkRetiredKept()
+
+	injected := errors.New("netlink busy")
+	device.FailNext(wg.FakeOpDevice, injected)
+	if _, err := g.DryRunOnce(context.Background()); !errors.Is(err, injected) {
+		t.Fatalf("expected the device read error from DryRunOnce, got %v", err)
+	}
+	if removals, _ := g.RunOnce(context.Background(), audit.ActorSystem); len(removals) != 1 || removals[0].PeerID != "peer-1" {
+		t.Fatalf("expected peer-1 removed, got %+v", removals)
+	}
+	if _, err := store.Get("peer-1"); !errors.Is(err, peers.ErrNotFound) {
+		t.Fatalf("expected peer removed, got err %v", err)
+	}
+	if _, ok := device.Peer(retired); ok {
+		t.Fatalf("expected retired key removed with the peer")
 	}
 }
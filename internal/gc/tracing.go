@@ -0,0 +1,23 @@
+package gc
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var tracer = otel.Tracer("github.com/example/wireguard-gateway/internal/gc")
+
+// traced runs fn in a child span of ctx named after the operation and
+// records its error on the span.
+func traced(ctx context.Context, name string, fn func() error) error {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
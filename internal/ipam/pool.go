@@ -0,0 +1,116 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ErrExhausted indicates that every address in the pool is allocated.
+var ErrExhausted = errors.New("address pool exhausted")
+
+// ErrOutOfRange indicates that an address does not belong to the pool.
+var ErrOutOfRange = errors.New("address outside pool")
+
+// Pool hands out IPv4 host addresses from a prefix.
+type Pool struct {
+	mu     sync.Mutex
+	prefix netip.Prefix
+	used   map[netip.Addr]struct{}
+	next   netip.Addr
+}
+
+// NewPool constructs a pool for the given IPv4 CIDR. The network and
+// broadcast addresses are never handed out.
+func NewPool(cidr string) (*Pool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("parse pool %q: %w", cidr, err)
+	}
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("pool %q is not ipv4", cidr)
+	}
+	if prefix.Bits() > 30 {
+		return nil, fmt.Errorf("pool %q is too small", cidr)
+	}
+	prefix = prefix.Masked()
+	return &Pool{
+		prefix: prefix,
+		used:   make(map[netip.Addr]struct{}),
+		next:   prefix.Addr().Next(),
+	}, nil
+}
+
+// Prefix returns the pool's network.
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Allocate reserves the next free address.
+func (p *Pool) Allocate() (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	addr := start
+	for {
+		if p.usable(addr) {
+			if _, taken := p.used[addr]; !taken {
+				p.used[addr] = struct{}{}
+				p.next = p.advance(addr)
+				return net.IP(addr.AsSlice()), nil
+			}
+		}
+		addr = p.advance(addr)
+		if addr == start {
+			return nil, ErrExhausted
+		}
+	}
+}
+
+// Reserve marks ip as allocated, e.g. for the server's own address.
+func (p *Pool) Reserve(ip net.IP) error {
+	addr, err := p.addr(ip)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used[addr] = struct{}{}
+	return nil
+}
+
+// Release returns ip to the pool.
+func (p *Pool) Release(ip net.IP) error {
+	addr, err := p.addr(ip)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, addr)
+	return nil
+}
+
+func (p *Pool) addr(ip net.IP) (netip.Addr, error) {
+	addr, ok := netip.AddrFromSlice(ip.To4())
+	if !ok || !p.prefix.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrOutOfRange, ip)
+	}
+	return addr, nil
+}
+
+func (p *Pool) usable(addr netip.Addr) bool {
+	return addr != p.prefix.Addr() && p.advance(addr) != p.prefix.Addr()
+}
+
+// advance returns the address after addr, wrapping around within the prefix.
+func (p *Pool) advance(addr netip.Addr) netip.Addr {
+	next := addr.Next()
+	if !next.IsValid() || !p.prefix.Contains(next) {
+		return p.prefix.Addr()
+	}
+	return next
+}
@@ -0,0 +1,61 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPoolAllocateSkipsNetworkAndBroadcast(t *testing.T) {
+	pool, err := NewPool("10.0.0.0/30")
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	first, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	second, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if first.String() != "10.0.0.1" || second.String() != "10.0.0.2" {
+		t.Fatalf("unexpected addresses %s, %s", first, second)
+	}
+
+	if _, err := pool.Allocate(); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+
+	if err := pool.Release(first); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	again, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate after release: %v", err)
+	}
+	if !again.Equal(first) {
+		t.Fatalf("expected %s to be reused, got %s", first, again)
+	}
+}
+
+func TestPoolReserve(t *testing.T) {
+	pool, err := NewPool("10.0.0.0/29")
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	if err := pool.Reserve(net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	ip, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if ip.String() != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", ip)
+	}
+	if err := pool.Reserve(net.ParseIP("192.168.0.1")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("expected ErrOutOfRange, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package peers
+
+import "sync"
+
+// peerLocks holds a mutex per locked peer ID. The zero value is ready to
+// use.
+type peerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*peerLock
+}
+
+type peerLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the peer with the given ID and returns the unlock function.
+func (l *peerLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*peerLock)
+	}
+	pl, ok := l.locks[id]
+	if !ok {
+		pl = &peerLock{}
+		l.locks[id] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.mu.Lock()
+	return func() {
+		pl.mu.Unlock()
+		l.mu.Lock()
+		if pl.refs--; pl.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Lock serializes changes to the peer with the given ID, such as key
+// rotations and removals, so that they cannot leave keys behind on the
+// device. It returns the unlock function. Reads are not blocked, so a
+// caller that acts on a peer must load it again after locking.
+func (s *Store) Lock(id string) func() {
+	return s.locks.lock(id)
+}
@@ -3,10 +3,26 @@ package peers
 import (
 	"errors"
 	"net"
+	"slices"
 	"sync"
 	"time"
 )
 
+// State is the connection state of a peer.
+type State string
+
+// Connection states.
+const (
+	// StatePending peers never completed a handshake.
+	StatePending State = "pending"
+	// StateConnected peers completed a handshake recently.
+	StateConnected State = "connected"
+	// StateIdle peers have connected, but not recently.
+	StateIdle State = "idle"
+	// StateStale peers have not connected for a long time.
+	StateStale State = "stale"
+)
+
 // Peer represents a managed WireGuard peer.
 type Peer struct {
 	ID              string
@@ -16,29 +32,88 @@ type Peer struct {
 	ClientIPv4      net.IP
 	AllowedCIDR     string
 	Interface       string
+	Owner           string
+	Note            string
 	CreatedAt       time.Time
 	LastHandshakeAt *time.Time
+	// FirstConnectedAt is the time of the first handshake, nil before it.
+	FirstConnectedAt *time.Time
+	// Endpoint is the peer's last known remote address.
+	Endpoint       string
+	State          State
+	StateChangedAt time.Time
+	// RetiredKeys are previous keys that stay on the device, each with its
+	// own address, until their overlap ends.
+	RetiredKeys []RetiredKey
+}
+
+// RetiredKey is a rotated-out public key kept usable for an overlap.
+type RetiredKey struct {
+	PublicKey   string
+	AllowedCIDR string
+	Until       time.Time
+}
+
+// PublicKeys returns the peer's public key followed by its retired keys.
+func (p *Peer) PublicKeys() []string {
+	keys := []string{p.PublicKey}
+	for _, retired := range p.RetiredKeys {
+		keys = append(keys, retired.PublicKey)
+	}
+	return keys
+}
+
+// AllowedCIDRs returns the peer's address followed by those of its retired
+// keys.
+func (p *Peer) AllowedCIDRs() []string {
+	cidrs := []string{p.AllowedCIDR}
+	for _, retired := range p.RetiredKeys {
+		cidrs = append(cidrs, retired.AllowedCIDR)
+	}
+	return cidrs
+}
+
+// Connection is the observed connection of a peer.
+type Connection struct {
+	// LastHandshakeAt is zero when no handshake was seen.
+	LastHandshakeAt time.Time
+	// Endpoint is empty when unknown.
+	Endpoint string
+	State    State
 }
 
 // Store provides concurrent-safe access to peers.
 type Store struct {
 	mu    sync.RWMutex
 	peers map[string]*Peer
+	locks peerLocks
 }
 
 // ErrNotFound indicates that a peer is missing from the store.
 var ErrNotFound = errors.New("peer not found")
 
+// ErrExists indicates that a peer with the same ID is already stored.
+var ErrExists = errors.New("peer already exists")
+
 // NewStore constructs an empty peer store.
 func NewStore() *Store {
 	return &Store{peers: make(map[string]*Peer)}
 }
 
-// Add inserts a peer into the store.
-func (s *Store) Add(peer *Peer) {
+// Add inserts a peer into the store. A peer without a state starts out
+// pending.
+func (s *Store) Add(peer *Peer) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, ok := s.peers[peer.ID]; ok {
+		return ErrExists
+	}
+	if peer.State == "" {
+		peer.State = StatePending
+		peer.StateChangedAt = peer.CreatedAt
+	}
 	s.peers[peer.ID] = peer
+	return nil
 }
 
 // Get retrieves a peer by ID.
@@ -78,14 +153,86 @@ func (s *Store) List() []*Peer {
 	return out
 }
 
-// UpdateHandshake sets the last handshake time for a peer.
-func (s *Store) UpdateHandshake(id string, t time.Time) error {
+// UpdateConnection records the connection of a peer observed at now. A
+// handshake sets FirstConnectedAt the first time and a different state sets
+// StateChangedAt; a zero handshake or empty endpoint keeps the stored one.
+// It returns the peer as it was before the update.
+func (s *Store) UpdateConnection(id string, conn Connection, now time.Time) (*Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	prev := *peer
+	if !conn.LastHandshakeAt.IsZero() {
+		t := conn.LastHandshakeAt
+		peer.LastHandshakeAt = &t
+		if peer.FirstConnectedAt == nil {
+			peer.FirstConnectedAt = &t
+		}
+	}
+	if conn.Endpoint != "" {
+		peer.Endpoint = conn.Endpoint
+	}
+	if conn.State != "" && conn.State != peer.State {
+		peer.State = conn.State
+		peer.StateChangedAt = now
+	}
+	return &prev, nil
+}
+
+// UpdateKeys replaces the key material of a peer.
+func (s *Store) UpdateKeys(id, publicKey, privateKey, presharedKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	peer.PublicKey = publicKey
+	peer.PrivateKey = privateKey
+	peer.PresharedKey = presharedKey
+	return nil
+}
+
+// UpdateAddress moves a peer to a new address.
+func (s *Store) UpdateAddress(id string, clientIPv4 net.IP, allowedCIDR string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	peer.ClientIPv4 = clientIPv4
+	peer.AllowedCIDR = allowedCIDR
+	return nil
+}
+
+// AddRetiredKey records a rotated-out key of a peer.
+func (s *Store) AddRetiredKey(id string, retired RetiredKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	// Copies handed out share the slice, so it is never modified in place.
+	peer.RetiredKeys = append(slices.Clip(peer.RetiredKeys), retired)
+	return nil
+}
+
+// RemoveRetiredKeys forgets the retired keys of a peer with the given
+// public keys.
+func (s *Store) RemoveRetiredKeys(id string, publicKeys []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	peer, ok := s.peers[id]
 	if !ok {
 		return ErrNotFound
 	}
-	peer.LastHandshakeAt = &t
+	peer.RetiredKeys = slices.DeleteFunc(slices.Clone(peer.RetiredKeys), func(retired RetiredKey) bool {
+		return slices.Contains(publicKeys, retired.PublicKey)
+	})
 	return nil
 }
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/example/wireguard-gateway/internal/audit"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+
+	// authFailureAuditLimit is how many auth failures are recorded per
+	// authFailureAuditWindow. Unauthenticated callers cannot grow the log
+	// faster than that.
+	authFailureAuditLimit  = 60
+	authFailureAuditWindow = time.Minute
+)
+
+// auditLimiter admits authFailureAuditLimit events per
+// authFailureAuditWindow and counts the ones it turns away. The zero value
+// is ready to use.
+type auditLimiter struct {
+	mu      sync.Mutex
+	start   time.Time
+	count   int
+	dropped int
+}
+
+// allow reports whether an event at now may be recorded and, if so, how
+// many events were turned away since the last one that was.
+func (l *auditLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.start) >= authFailureAuditWindow {
+		l.start, l.count = now, 0
+	}
+	if l.count >= authFailureAuditLimit {
+		l.dropped++
+		return false, 0
+	}
+	l.count++
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
+
+// recordAudit adds the caller's identity, address and request ID to an
+// event and appends it to the audit log. Failures are logged.
+func (s *Server) recordAudit(c *gin.Context, event audit.Event) {
+	if s.opts.Audit == nil {
+		return
+	}
+	if event.Actor == "" {
+		event.Actor = jwtSubject(c)
+		if isAdmin(c) {
+			event.Actor = audit.ActorAdmin
+		}
+	}
+	event.ClientIP = c.ClientIP()
+	event.RequestID = c.GetString(requestIDContextKey)
+	if err := s.opts.Audit.Record(event); err != nil {
+		requestLog(c).Error("record audit event", "action", event.Action, "error", err)
+	}
+}
+
+// auditAuthFailures records the requests rejected by the auth middleware.
+func (s *Server) auditAuthFailures(c *gin.Context) {
+	c.Next()
+	if c.Writer.Status() != http.StatusUnauthorized {
+		return
+	}
+	reason := "missing credentials"
+	switch header := c.GetHeader("Authorization"); {
+	case strings.HasPrefix(header, "Basic "):
+		reason = "invalid basic credentials"
+	case strings.HasPrefix(header, "Bearer "):
+		reason = "invalid token"
+	}
+	reason += ": " + c.Request.Method + " " + c.Request.URL.Path
+	ok, dropped := s.authFailures.allow(time.Now())
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		reason += fmt.Sprintf(" (%d earlier failures not recorded)", dropped)
+	}
+	s.recordAudit(c, audit.Event{Action: audit.ActionAuthFailed, Reason: reason})
+}
+
+func (s *Server) handleQueryAudit(c *gin.Context) {
+	if s.opts.Audit == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "audit log not configured"})
+		return
+	}
+	filter := audit.Filter{
+		Action:    c.Query("action"),
+		Actor:     c.Query("actor"),
+		PeerID:    c.Query("peer_id"),
+		Interface: c.Query("interface"),
+		Limit:     defaultAuditLimit,
+	}
+	var err error
+	if filter.Since, err = queryTime(c, "since"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+		return
+	}
+	if filter.Until, err = queryTime(c, "until"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until"})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	events, err := s.opts.Audit.Query(filter)
+	if err != nil {
+		requestLog(c).Error("query audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query audit log"})
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+func (s *Server) handleVerifyAudit(c *gin.Context) {
+	if s.opts.Audit == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "audit log not configured"})
+		return
+	}
+	if err := s.opts.Audit.Verify(); err != nil {
+		if errors.Is(err, audit.ErrTampered) || errors.Is(err, audit.ErrCorrupt) || errors.Is(err, audit.ErrNoHashChain) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		requestLog(c).Error("verify audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "verify audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// queryTime parses an optional RFC 3339 query parameter.
+func queryTime(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	claimsContextKey = "jwt_claims"
+	adminContextKey  = "admin"
+)
+
+func requireBasicAuth(username, password string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validBasicAuth(c.GetHeader("Authorization"), username, password) {
+			unauthorizedBasic(c)
+			return
+		}
+
+		c.Set(adminContextKey, true)
+		c.Next()
+	}
+}
+
+func validBasicAuth(header, username, password string) bool {
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	expected := username + ":" + password
+	return subtle.ConstantTimeCompare(decoded, []byte(expected)) == 1
+}
+
+func unauthorizedBasic(c *gin.Context) {
+	c.Header("WWW-Authenticate", "Basic realm=\"restricted\"")
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	c.Abort()
+}
+
+func requireJWTAuth(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := validJWT(c.GetHeader("Authorization"), secret)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			c.Abort()
+			return
+		}
+
+		c.Set(claimsContextKey, claims)
+		c.Next()
+	}
+}
+
+// requireOwnerOrAdmin accepts either the administrative basic credentials
+// or a valid JWT. Handlers check ownership with isAdmin and jwtSubject.
+func requireOwnerOrAdmin(username, password, secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if validBasicAuth(header, username, password) {
+			c.Set(adminContextKey, true)
+			c.Next()
+			return
+		}
+		if claims, ok := validJWT(header, secret); ok {
+			c.Set(claimsContextKey, claims)
+			c.Next()
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		c.Abort()
+	}
+}
+
+func validJWT(header, secret string) (jwt.MapClaims, bool) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+
+	tokenStr := header[len(prefix):]
+	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	return claims, true
+}
+
+// jwtClaims returns the validated claims of the current request, if any.
+func jwtClaims(c *gin.Context) jwt.MapClaims {
+	value, ok := c.Get(claimsContextKey)
+	if !ok {
+		return nil
+	}
+	claims, _ := value.(jwt.MapClaims)
+	return claims
+}
+
+// jwtSubject returns the sub claim of the current request, if any.
+func jwtSubject(c *gin.Context) string {
+	sub, _ := jwtClaims(c)["sub"].(string)
+	return sub
+}
+
+// isAdmin reports whether the request authenticated with basic credentials.
+func isAdmin(c *gin.Context) bool {
+	return c.GetBool(adminContextKey)
+}
+
+// canAccessPeer reports whether the caller is an admin or owns the peer.
+func canAccessPeer(c *gin.Context, owner string) bool {
+	if isAdmin(c) {
+		return true
+	}
+	sub := jwtSubject(c)
+	return sub != "" && sub == owner
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+
+	"github.com/example/wireguard-gateway/internal/peers"
+	templater "github.com/example/wireguard-gateway/internal/template"
+	"github.com/example/wireguard-gateway/internal/wg"
+	"github.com/example/wireguard-gateway/internal/wgquick"
+)
+
+// responseFormat identifies a representation of a peer configuration.
+type responseFormat string
+
+const (
+	// formatJSON renders the selected template, which produces JSON unless
+	// a named text template was picked.
+	formatJSON    responseFormat = "json"
+	formatWGQuick responseFormat = "wg-quick"
+	formatQRPNG   responseFormat = "qr-png"
+	formatQRText  responseFormat = "qr-text"
+)
+
+const (
+	mimePNG = "image/png"
+
+	// qrPNGSize is the width and height of PNG QR codes in pixels.
+	qrPNGSize = 512
+)
+
+// errQRCode indicates that a configuration could not be encoded as a QR
+// code, typically because it is too large for one.
+var errQRCode = errors.New("encode QR code")
+
+// negotiateFormat picks the peer response format from the format query
+// parameter or, failing that, the Accept header. JSON is the default. Like
+// gin's negotiation, the first Accept entry for JSON or text decides: a
+// template parameter on it selects that template, and text/plain without
+// one selects wg-quick. A QR code is a PNG image unless the client prefers
+// text/plain, in which case it is drawn with block characters for a
+// terminal.
+func negotiateFormat(c *gin.Context) (responseFormat, bool) {
+	switch format := strings.ToLower(c.Query("format")); format {
+	case "":
+	case string(formatJSON), string(formatWGQuick):
+		return responseFormat(format), true
+	case "qr":
+		if c.NegotiateFormat(mimePNG, gin.MIMEPlain) == gin.MIMEPlain {
+			return formatQRText, true
+		}
+		return formatQRPNG, true
+	default:
+		return "", false
+	}
+
+	mediaType, template := preferredAccept(c)
+	if template == "" && mediaType == gin.MIMEPlain {
+		return formatWGQuick, true
+	}
+	return formatJSON, true
+}
+
+func badFormat(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported format"})
+}
+
+func unknownTemplate(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "unknown template"})
+}
+
+// selectTemplate picks the template for a peer response. A name given in
+// the request wins over a template parameter in the Accept header, which
+// wins over the caller's template claim. Without any of them the
+// interface's own template is used.
+func (s *Server) selectTemplate(c *gin.Context, iface *Interface, requested string) (*templater.Renderer, bool) {
+	name := requested
+	if name == "" {
+		_, name = preferredAccept(c)
+	}
+	// Without a template set the claim has nothing to name.
+	if name == "" && s.opts.Templates != nil {
+		name, _ = jwtClaims(c)[TemplateClaim].(string)
+	}
+	if name == "" {
+		return iface.Renderer, true
+	}
+	return s.opts.Templates.Get(name)
+}
+
+// preferredAccept returns the media type and template parameter of the
+// first Accept entry that asks for JSON or text, as in
+// "Accept: application/json; template=android". Wildcards count as JSON.
+// Entries for other media types are skipped, so their parameters do not
+// apply.
+func preferredAccept(c *gin.Context) (mediaType, template string) {
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accept)
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case gin.MIMEJSON, "application/*", "*/*":
+			return gin.MIMEJSON, params["template"]
+		case gin.MIMEPlain, "text/*":
+			return gin.MIMEPlain, params["template"]
+		}
+	}
+	return gin.MIMEJSON, ""
+}
+
+// renderFailed reports a peer response that could not be rendered.
+func renderFailed(c *gin.Context, logger *slog.Logger, err error) {
+	if errors.Is(err, errQRCode) {
+		logger.Error("render QR code", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "QR code encoding failed"})
+		return
+	}
+	logger.Error("render template", "error", err)
+	if errors.Is(err, templater.ErrInvalidJSON) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "template produced invalid JSON"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "template render failed"})
+}
+
+// renderPeer produces the peer configuration in the requested format.
+func (s *Server) renderPeer(ctx context.Context, format responseFormat, iface *Interface, renderer *templater.Renderer, peer *peers.Peer, claims map[string]any) (string, []byte, error) {
+	info := s.deviceInfo(iface.Name)
+	switch format {
+	case formatWGQuick:
+		return wgquick.ContentType, wgQuickConfig(iface, peer, info).Marshal(), nil
+	case formatQRPNG, formatQRText:
+		code, err := qrcode.New(string(wgQuickConfig(iface, peer, info).Marshal()), qrcode.Medium)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %w", errQRCode, err)
+		}
+		if format == formatQRText {
+			return wgquick.ContentType, []byte(code.ToSmallString(false)), nil
+		}
+		png, err := code.PNG(qrPNGSize)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %w", errQRCode, err)
+		}
+		return mimePNG, png, nil
+	}
+
+	rendered, err := tracedValue(ctx, "template.Render", func() (string, error) {
+		return renderer.Render(templateData(iface, peer, info, claims))
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return renderer.ContentType(), []byte(rendered), nil
+}
+
+// wgQuickConfig builds the client-side wg-quick configuration for a peer.
+func wgQuickConfig(iface *Interface, peer *peers.Peer, info wg.DeviceInfo) wgquick.Config {
+	allowedIPs := iface.ClientAllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"0.0.0.0/0"}
+	}
+	return wgquick.Config{
+		PrivateKey:          peer.PrivateKey,
+		Address:             peer.AllowedCIDR,
+		DNS:                 iface.ClientDNS,
+		MTU:                 info.MTU,
+		PeerPublicKey:       info.PublicKey.String(),
+		PresharedKey:        peer.PresharedKey,
+		Endpoint:            clientEndpoint(iface, info),
+		AllowedIPs:          allowedIPs,
+		PersistentKeepalive: iface.PersistentKeepaliveSeconds,
+	}
+}
+
+// clientEndpoint returns the endpoint clients connect to: the overlap
+// endpoint while the newest key is served on the overlap port, which
+// a finished rotation leaves the interface on, and Endpoint otherwise.
+func clientEndpoint(iface *Interface, info wg.DeviceInfo) string {
+	if iface.OverlapEndpoint != "" && info.ListenPort == iface.OverlapListenPort {
+		return iface.OverlapEndpoint
+	}
+	return iface.Endpoint
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/gc"
+)
+
+// Collector runs garbage collection cycles for an interface on demand.
+type Collector interface {
+	RunOnce(ctx context.Context, actor string) ([]gc.Removal, error)
+	DryRunOnce(ctx context.Context) ([]gc.Removal, error)
+	DryRun() bool
+}
+
+type runGCRequest struct {
+	// DryRun reports what would be removed without removing it. A
+	// collector configured for dry runs never removes peers.
+	DryRun bool `json:"dry_run"`
+	// Interface limits the cycle to one interface.
+	Interface string `json:"interface"`
+}
+
+type gcResult struct {
+	Interface string       `json:"interface"`
+	DryRun    bool         `json:"dry_run"`
+	Removed   []gc.Removal `json:"removed"`
+	// Error reports a failed device read or update. The peers a failed
+	// update covered are kept for the next cycle.
+	Error string `json:"error,omitempty"`
+}
+
+func (s *Server) handleRunGC(c *gin.Context) {
+	var req runGCRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	if req.Interface != "" {
+		iface, ok := s.interfaces[req.Interface]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "interface not found"})
+			return
+		}
+		if iface.Collector == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "garbage collection not configured"})
+			return
+		}
+	}
+
+	results := []gcResult{}
+	status := http.StatusOK
+	for _, iface := range s.opts.Interfaces {
+		if iface.Collector == nil || req.Interface != "" && iface.Name != req.Interface {
+			continue
+		}
+		result := gcResult{Interface: iface.Name, DryRun: req.DryRun || iface.Collector.DryRun()}
+		var err error
+		if result.DryRun {
+			result.Removed, err = iface.Collector.DryRunOnce(c.Request.Context())
+		} else {
+			// Only basic credentials reach this handler.
+			result.Removed, err = iface.Collector.RunOnce(c.Request.Context(), audit.ActorAdmin)
+		}
+		if err != nil {
+			requestLog(c).Error("garbage collection failed", "interface", iface.Name, "error", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		requestLog(c).Info("garbage collection triggered", "interface", iface.Name, "dry_run", result.DryRun, "removed", len(result.Removed))
+		results = append(results, result)
+	}
+	c.JSON(status, gin.H{"results": results})
+}
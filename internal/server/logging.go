@@ -0,0 +1,99 @@
+package server
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	loggerContextKey    = "logger"
+	requestIDContextKey = "request_id"
+)
+
+// RequestIDHeader carries the request ID in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDHeaders lists the headers an incoming request ID is taken from,
+// in order of preference. CF-Ray is set by Cloudflare.
+var requestIDHeaders = []string{RequestIDHeader, "CF-Ray"}
+
+// maxRequestIDLength bounds incoming request IDs.
+const maxRequestIDLength = 128
+
+// requestLogger assigns the request ID, logs every request and gives
+// handlers a logger that carries the request ID and client address. An
+// incoming request ID is only taken from requests sent by one of the
+// trusted proxies, since it ends up in the audit log.
+func requestLogger(base *slog.Logger, trustedProxies []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := uuid.NewString()
+		if slices.Contains(trustedProxies, c.RemoteIP()) {
+			id = incomingRequestID(c)
+		}
+		c.Set(requestIDContextKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Set(loggerContextKey, base.With("request_id", id, "client_ip", c.ClientIP()))
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		requestLog(c).Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"latency", time.Since(start),
+		)
+	}
+}
+
+// incomingRequestID returns the request ID supplied by a proxy, or a new
+// one when there is none or it is not a plain token.
+func incomingRequestID(c *gin.Context) string {
+	for _, header := range requestIDHeaders {
+		if id := c.GetHeader(header); validRequestID(id) {
+			return id
+		}
+	}
+	return uuid.NewString()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLog returns the logger of the current request. It carries the
+// trace ID when the request is traced and, once the caller is
+// authenticated, their JWT subject or admin status.
+func requestLog(c *gin.Context) *slog.Logger {
+	logger := slog.Default()
+	if value, ok := c.Get(loggerContextKey); ok {
+		logger = value.(*slog.Logger)
+	}
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	if sub := jwtSubject(c); sub != "" {
+		logger = logger.With("subject", sub)
+	} else if isAdmin(c) {
+		logger = logger.With("admin", true)
+	}
+	return logger
+}
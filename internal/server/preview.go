@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	templater "github.com/example/wireguard-gateway/internal/template"
+)
+
+type previewTemplateRequest struct {
+	// Template names a template from the template directory. Without it
+	// the interface's own template is previewed.
+	Template string `json:"template"`
+	// Interface supplies the device values and default template; the
+	// default interface is used when empty.
+	Interface string `json:"interface"`
+	// Body is template source to render instead of a loaded template.
+	Body string `json:"body"`
+	// Text renders Body as plain text instead of JSON.
+	Text bool `json:"text"`
+	// Data replaces values of the sample peer, e.g. {"Note": "x"}.
+	Data map[string]any `json:"data"`
+}
+
+func (s *Server) handlePreviewTemplate(c *gin.Context) {
+	var req previewTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	if req.Body != "" && req.Template != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body and template are mutually exclusive"})
+		return
+	}
+
+	iface := &s.opts.Interfaces[0]
+	if req.Interface != "" {
+		var ok bool
+		if iface, ok = s.interfaces[req.Interface]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown interface"})
+			return
+		}
+	}
+
+	renderer := iface.Renderer
+	switch {
+	case req.Body != "":
+		var err error
+		renderer, err = templater.Compile(req.Body, !req.Text, templater.Options{Env: s.opts.TemplateEnv})
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	case req.Template != "":
+		var ok bool
+		if renderer, ok = s.opts.Templates.Get(req.Template); !ok {
+			unknownTemplate(c)
+			return
+		}
+	}
+
+	data := templateData(iface, samplePeer(iface.Name), s.deviceInfo(iface.Name), sampleClaims())
+	for key, value := range req.Data {
+		data[key] = value
+	}
+	// The fallback would hide the error the preview is meant to show.
+	output, err := tracedValue(c.Request.Context(), "template.Render", func() (string, error) {
+		return renderer.RenderStrict(data)
+	})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"output": output, "content_type": renderer.ContentType()})
+}
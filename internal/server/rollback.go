@@ -0,0 +1,25 @@
+package server
+
+import "log/slog"
+
+// rollback collects compensating actions for a multi-step operation.
+type rollback struct {
+	log   *slog.Logger
+	steps []func() error
+}
+
+// add registers the compensation for a step that has completed.
+func (r *rollback) add(step func() error) {
+	r.steps = append(r.steps, step)
+}
+
+// run executes the compensations in reverse order. Failures are logged and
+// do not stop the remaining steps.
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if err := r.steps[i](); err != nil {
+			r.log.Error("rollback", "error", err)
+		}
+	}
+	r.steps = nil
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/peers"
+	"github.com/example/wireguard-gateway/internal/wg"
+)
+
+// maxPeerKeyOverlap bounds how long a rotated-out peer key stays on the device.
+const maxPeerKeyOverlap = 10 * time.Minute
+
+type rotatePeerRequest struct {
+	// OverlapSeconds keeps the old key and its address usable for this
+	// long, while the new key gets a new address.
+	OverlapSeconds int `json:"overlap_seconds"`
+	// Template names the template for the response.
+	Template string `json:"template"`
+}
+
+func (s *Server) handleRotatePeerKey(c *gin.Context) {
+	format, ok := negotiateFormat(c)
+	if !ok {
+		badFormat(c)
+		return
+	}
+
+	var req rotatePeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	overlap := time.Duration(req.OverlapSeconds) * time.Second
+	if overlap < 0 || overlap > maxPeerKeyOverlap {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "overlap_seconds out of range"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	unlock := s.opts.PeerStore.Lock(c.Param("id"))
+	defer unlock()
+	peer, err := tracedValue(ctx, "store.Get", func() (*peers.Peer, error) {
+		return s.opts.PeerStore.Get(c.Param("id"))
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+		return
+	}
+	// Non-owners see the same response as for a missing peer.
+	if !canAccessPeer(c, peer.Owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+		return
+	}
+
+	iface, ok := s.interfaces[peer.Interface]
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unknown interface"})
+		return
+	}
+	renderer, ok := s.selectTemplate(c, iface, req.Template)
+	if !ok {
+		unknownTemplate(c)
+		return
+	}
+	// Both keys stay routable during an overlap only with distinct
+	// addresses, which need a pool.
+	if overlap > 0 && iface.Pool == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "overlap_seconds requires an address pool"})
+		return
+	}
+
+	logger := requestLog(c).With("peer_id", peer.ID, "interface", iface.Name)
+
+	oldKey, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "parse public key"})
+		return
+	}
+	oldPreshared, err := parseOptionalKey(peer.PresharedKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "parse preshared key"})
+		return
+	}
+	_, allowedNet, err := net.ParseCIDR(peer.AllowedCIDR)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "parse allowed ip"})
+		return
+	}
+	allowedIPs := []net.IPNet{*allowedNet}
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		logger.Error("generate private key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "generate key"})
+		return
+	}
+	publicKey := privateKey.PublicKey()
+
+	var preshared *wgtypes.Key
+	var presharedString string
+	if s.opts.UsePresharedKey {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			logger.Error("generate preshared key", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "generate preshared key"})
+			return
+		}
+		preshared = &key
+		presharedString = key.String()
+	}
+
+	undo := rollback{log: logger}
+	committed := false
+	defer func() {
+		if !committed {
+			undo.run()
+		}
+	}()
+
+	rotated := *peer
+	rotated.PublicKey = publicKey.String()
+	rotated.PrivateKey = privateKey.String()
+	rotated.PresharedKey = presharedString
+
+	if overlap > 0 {
+		ip, err := iface.Pool.Allocate()
+		if err != nil {
+			logger.Warn("allocate address", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "address pool exhausted"})
+			return
+		}
+		undo.add(func() error { return iface.Pool.Release(ip) })
+		allowed, err := wg.AllowedIPNet(ip)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid allowed ip"})
+			return
+		}
+		rotated.ClientIPv4, rotated.AllowedCIDR = ip, allowed.String()
+
+		if err := traced(ctx, "wg.AddPeer", func() error {
+			return iface.Manager.AddPeer(publicKey, preshared, []net.IPNet{allowed})
+		}); err != nil {
+			logger.Error("add peer", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "add peer"})
+			return
+		}
+		undo.add(func() error { return iface.Manager.RemovePeer(publicKey) })
+
+		if err := traced(ctx, "store.AddRetiredKey", func() error {
+			return s.opts.PeerStore.AddRetiredKey(peer.ID, peers.RetiredKey{
+				PublicKey:   peer.PublicKey,
+				AllowedCIDR: peer.AllowedCIDR,
+				Until:       time.Now().Add(overlap).UTC(),
+			})
+		}); err != nil {
+			logger.Error("store retired key", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "store peer"})
+			return
+		}
+		undo.add(func() error {
+			return s.opts.PeerStore.RemoveRetiredKeys(peer.ID, []string{peer.PublicKey})
+		})
+
+		if err := traced(ctx, "store.UpdateAddress", func() error {
+			return s.opts.PeerStore.UpdateAddress(peer.ID, rotated.ClientIPv4, rotated.AllowedCIDR)
+		}); err != nil {
+			logger.Error("store address", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "store peer"})
+			return
+		}
+		undo.add(func() error {
+			return s.opts.PeerStore.UpdateAddress(peer.ID, peer.ClientIPv4, peer.AllowedCIDR)
+		})
+	} else {
+		if err := traced(ctx, "wg.ReplacePeer", func() error {
+			return iface.Manager.ReplacePeer(oldKey, publicKey, preshared, allowedIPs)
+		}); err != nil {
+			logger.Error("replace peer", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "replace peer"})
+			return
+		}
+		undo.add(func() error {
+			return iface.Manager.ReplacePeer(publicKey, oldKey, oldPreshared, allowedIPs)
+		})
+	}
+
+	if err := traced(ctx, "store.UpdateKeys", func() error {
+		return s.opts.PeerStore.UpdateKeys(peer.ID, rotated.PublicKey, rotated.PrivateKey, rotated.PresharedKey)
+	}); err != nil {
+		logger.Error("store rotated keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "store peer"})
+		return
+	}
+	undo.add(func() error {
+		return s.opts.PeerStore.UpdateKeys(peer.ID, peer.PublicKey, peer.PrivateKey, peer.PresharedKey)
+	})
+
+	contentType, body, err := s.renderPeer(ctx, format, iface, renderer, &rotated, jwtClaims(c))
+	if err != nil {
+		renderFailed(c, logger, err)
+		return
+	}
+
+	// The garbage collector removes a retired key once its overlap ends.
+	committed = true
+	logger.Info("peer key rotated", "overlap", overlap)
+	s.recordAudit(c, audit.Event{Action: audit.ActionPeerKeyRotated, PeerID: peer.ID, Interface: iface.Name})
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// parseOptionalKey parses a stored key, returning nil for an empty string.
+func parseOptionalKey(s string) (*wgtypes.Key, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := wgtypes.ParseKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
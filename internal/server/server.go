@@ -2,21 +2,24 @@ package server
 
 import (
 	"context"
-	"crypto/subtle"
-	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/events"
+	"github.com/example/wireguard-gateway/internal/ipam"
 	"github.com/example/wireguard-gateway/internal/peers"
 	templater "github.com/example/wireguard-gateway/internal/template"
 	"github.com/example/wireguard-gateway/internal/wg"
@@ -25,50 +28,127 @@ import (
 // WireguardManager defines the subset of wg.Manager used by the server.
 type WireguardManager interface {
 	AddPeer(publicKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error
+	ReplacePeer(oldKey, newKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error
 	RemovePeer(publicKey wgtypes.Key) error
-	Handshakes() (map[string]time.Time, error)
+	RemovePeers(publicKeys []wgtypes.Key) error
+	Info() (wg.DeviceInfo, error)
 }
 
+// KeyRotator rotates the server key of an interface. During a rotation the
+// new key is served separately; MovePeer moves a peer there once it has
+// been sent a config for the new key.
+type KeyRotator interface {
+	Rotate() (wg.Rotation, error)
+	MovePeer(publicKey wgtypes.Key) error
+}
+
+// Interface describes a WireGuard interface peers can be placed on.
+type Interface struct {
+	Name     string
+	Endpoint string
+	Renderer *templater.Renderer
+	Manager  WireguardManager
+	// Pool assigns tunnel addresses to peers. When nil, the caller's IPv4
+	// address is used as the peer's allowed IP.
+	Pool *ipam.Pool
+	// Rotator enables server key rotation for the interface when set.
+	Rotator KeyRotator
+	// OverlapEndpoint is the public endpoint of OverlapListenPort, the
+	// port a key rotation serves the new key on. Configs carry it instead
+	// of Endpoint whenever the newest key is served on that port.
+	OverlapEndpoint   string
+	OverlapListenPort int
+	// Collector enables POST /admin/gc for the interface when set.
+	Collector Collector
+	// ClientAllowedIPs and ClientDNS populate wg-quick configs; AllowedIPs
+	// defaults to 0.0.0.0/0.
+	ClientAllowedIPs []string
+	ClientDNS        []string
+	// PersistentKeepaliveSeconds is advertised to clients in wg-quick configs.
+	PersistentKeepaliveSeconds int
+}
+
+// InterfaceClaim is the JWT claim that pins a new peer to an interface.
+const InterfaceClaim = "wg_interface"
+
+// TemplateClaim is the JWT claim that names the caller's default template.
+const TemplateClaim = "wg_template"
+
 // Options configures the HTTP server.
 type Options struct {
 	ListenAddr             string
-	Interface              string
-	Endpoint               string
 	TrustProxyLoopbackOnly bool
-	Renderer               *templater.Renderer
-	PeerStore              *peers.Store
-	Manager                WireguardManager
-	UsePresharedKey        bool
-	BasicAuthUsername      string
-	BasicAuthPassword      string
-	JWTSecret              string
+	// Interfaces lists the served interfaces; the first one is the default.
+	Interfaces []Interface
+	// Templates holds named templates callers can pick instead of their
+	// interface's Renderer. It may be nil.
+	Templates *templater.Set
+	// TemplateEnv lists the environment variables that templates submitted
+	// for preview may read.
+	TemplateEnv []string
+	// Logger receives request and error logs; slog.Default() when nil.
+	Logger *slog.Logger
+	// Audit records peer lifecycle events and auth failures. It may be nil.
+	Audit *audit.Log
+	// Events receives peer creations and deletions and feeds GET /events.
+	// It may be nil.
+	Events            *events.Bus
+	PeerStore         *peers.Store
+	UsePresharedKey   bool
+	BasicAuthUsername string
+	BasicAuthPassword string
+	JWTSecret         string
 }
 
 // Server wraps the Gin engine and HTTP server.
 type Server struct {
-	opts   Options
-	engine *gin.Engine
-	srv    *http.Server
+	opts       Options
+	interfaces map[string]*Interface
+	engine     *gin.Engine
+	srv        *http.Server
+	newPeerID  func() string
+	// authFailures bounds the auth failures written to the audit log.
+	authFailures auditLimiter
+	// closing is closed on shutdown so that open event streams return.
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	infoMu sync.RWMutex
+	info   map[string]wg.DeviceInfo
 }
 
 // New constructs a new Server.
 func New(opts Options) (*Server, error) {
-	if opts.Renderer == nil || opts.PeerStore == nil || opts.Manager == nil {
+	if opts.PeerStore == nil || len(opts.Interfaces) == 0 {
 		return nil, errors.New("missing dependencies")
 	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	interfaces := make(map[string]*Interface, len(opts.Interfaces))
+	for i := range opts.Interfaces {
+		iface := &opts.Interfaces[i]
+		if iface.Name == "" || iface.Renderer == nil || iface.Manager == nil {
+			return nil, errors.New("missing interface dependencies")
+		}
+		if _, ok := interfaces[iface.Name]; ok {
+			return nil, fmt.Errorf("duplicate interface %s", iface.Name)
+		}
+		interfaces[iface.Name] = iface
+	}
+
+	var trustedProxies []string
+	if opts.TrustProxyLoopbackOnly {
+		trustedProxies = []string{"127.0.0.1", "::1"}
+	}
 
 	engine := gin.New()
 	engine.Use(gin.Recovery())
-	engine.Use(requestLogger())
+	engine.Use(requestLogger(opts.Logger, trustedProxies))
+	engine.Use(requestTracer())
 
-	if opts.TrustProxyLoopbackOnly {
-		if err := engine.SetTrustedProxies([]string{"127.0.0.1", "::1"}); err != nil {
-			return nil, err
-		}
-	} else {
-		if err := engine.SetTrustedProxies(nil); err != nil {
-			return nil, err
-		}
+	if err := engine.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, err
 	}
 
 	if opts.BasicAuthUsername == "" || opts.BasicAuthPassword == "" {
@@ -78,27 +158,56 @@ func New(opts Options) (*Server, error) {
 		return nil, errors.New("jwt secret is required")
 	}
 
-	s := &Server{opts: opts, engine: engine}
+	s := &Server{
+		opts:       opts,
+		interfaces: interfaces,
+		engine:     engine,
+		newPeerID:  uuid.NewString,
+		closing:    make(chan struct{}),
+		info:       make(map[string]wg.DeviceInfo, len(interfaces)),
+	}
+	for _, iface := range opts.Interfaces {
+		if err := s.refreshInfo(&iface); err != nil {
+			return nil, err
+		}
+	}
+
+	engine.Use(s.auditAuthFailures)
 
 	basicAuth := requireBasicAuth(opts.BasicAuthUsername, opts.BasicAuthPassword)
 	jwtAuth := requireJWTAuth(opts.JWTSecret)
+	ownerOrAdmin := requireOwnerOrAdmin(opts.BasicAuthUsername, opts.BasicAuthPassword, opts.JWTSecret)
 
 	engine.GET("/healthz", basicAuth, s.handleHealthz)
 	engine.POST("/peer", jwtAuth, s.handleCreatePeer)
 	engine.DELETE("/peer/:id", basicAuth, s.handleDeletePeer)
+	engine.POST("/peer/:id/rotate", ownerOrAdmin, s.handleRotatePeerKey)
+	engine.GET("/peer/:id", ownerOrAdmin, s.handleGetPeer)
+	engine.GET("/peer/:id/config", ownerOrAdmin, s.handleGetPeerConfig)
+	engine.GET("/peers", ownerOrAdmin, s.handleListPeers)
 	engine.POST("/admin/reload-template", basicAuth, s.handleReloadTemplate)
+	engine.POST("/admin/interfaces/:name/rotate-key", basicAuth, s.handleRotateServerKey)
+	engine.POST("/admin/templates/preview", basicAuth, s.handlePreviewTemplate)
+	engine.GET("/admin/metrics", basicAuth, s.handleMetrics)
+	engine.POST("/admin/gc", basicAuth, s.handleRunGC)
+	engine.GET("/admin/audit", basicAuth, s.handleQueryAudit)
+	engine.GET("/admin/audit/verify", basicAuth, s.handleVerifyAudit)
+	engine.GET("/events", basicAuth, s.handleEventStream)
 
 	s.srv = &http.Server{
 		Addr:    opts.ListenAddr,
 		Handler: engine,
 	}
+	// Shutdown waits for active requests, which an event stream never
+	// finishes on its own.
+	s.srv.RegisterOnShutdown(s.closeStreams)
 
 	return s, nil
 }
 
 // Run starts the HTTP server and blocks until it stops.
 func (s *Server) Run() error {
-	log.Printf("listening on %s", s.opts.ListenAddr)
+	s.opts.Logger.Info("listening", "addr", s.opts.ListenAddr)
 	return s.srv.ListenAndServe()
 }
 
@@ -107,6 +216,11 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return s.srv.Shutdown(ctx)
 }
 
+// closeStreams ends every open event stream.
+func (s *Server) closeStreams() {
+	s.closingOnce.Do(func() { close(s.closing) })
+}
+
 // Handler exposes the underlying HTTP handler (primarily for tests).
 func (s *Server) Handler() http.Handler {
 	return s.engine
@@ -116,6 +230,22 @@ func (s *Server) handleHealthz(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// publishedMetrics are the expvar variables served at /admin/metrics. The
+// process variables expvar adds by itself, cmdline and memstats, are left
+// out since the command line may carry secrets.
+var publishedMetrics = []string{"template_reloads", "template_fallbacks", "webhook_deliveries"}
+
+func (s *Server) handleMetrics(c *gin.Context) {
+	metrics := make(map[string]json.RawMessage, len(publishedMetrics))
+	for _, name := range publishedMetrics {
+		// Variables of packages the binary does not use are not registered.
+		if v := expvar.Get(name); v != nil {
+			metrics[name] = json.RawMessage(v.String())
+		}
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
 func (s *Server) handleCreatePeer(c *gin.Context) {
 	clientIP := net.ParseIP(c.ClientIP())
 	if clientIP == nil {
@@ -127,6 +257,12 @@ func (s *Server) handleCreatePeer(c *gin.Context) {
 		return
 	}
 
+	format, ok := negotiateFormat(c)
+	if !ok {
+		badFormat(c)
+		return
+	}
+
 	var req createPeerRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		if !errors.Is(err, io.EOF) {
@@ -135,11 +271,23 @@ func (s *Server) handleCreatePeer(c *gin.Context) {
 		}
 	}
 
-	peerID := uuid.NewString()
+	iface, status, msg := s.selectInterface(c, req.Interface)
+	if iface == nil {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	renderer, ok := s.selectTemplate(c, iface, req.Template)
+	if !ok {
+		unknownTemplate(c)
+		return
+	}
+
+	peerID := s.newPeerID()
+	logger := requestLog(c).With("peer_id", peerID, "interface", iface.Name)
 
 	privateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		log.Printf("generate private key: %v", err)
+		logger.Error("generate private key", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "generate key"})
 		return
 	}
@@ -150,7 +298,7 @@ func (s *Server) handleCreatePeer(c *gin.Context) {
 	if s.opts.UsePresharedKey {
 		key, err := wgtypes.GenerateKey()
 		if err != nil {
-			log.Printf("generate preshared key: %v", err)
+			logger.Error("generate preshared key", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "generate preshared key"})
 			return
 		}
@@ -158,17 +306,43 @@ func (s *Server) handleCreatePeer(c *gin.Context) {
 		presharedString = key.String()
 	}
 
-	allowedNet, err := wg.AllowedIPNet(clientIP)
+	// Every step below registers its compensation; unless the response is
+	// committed, they run in reverse order so a failed request leaves no
+	// address, device peer or store entry behind.
+	undo := rollback{log: logger}
+	committed := false
+	defer func() {
+		if !committed {
+			undo.run()
+		}
+	}()
+
+	peerIP := clientIP
+	if iface.Pool != nil {
+		peerIP, err = iface.Pool.Allocate()
+		if err != nil {
+			logger.Warn("allocate address", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "address pool exhausted"})
+			return
+		}
+		undo.add(func() error { return iface.Pool.Release(peerIP) })
+	}
+
+	allowedNet, err := wg.AllowedIPNet(peerIP)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "build allowed ip"})
 		return
 	}
 
-	if err := s.opts.Manager.AddPeer(publicKey, preshared, []net.IPNet{allowedNet}); err != nil {
-		log.Printf("add peer: %v", err)
+	ctx := c.Request.Context()
+	if err := traced(ctx, "wg.AddPeer", func() error {
+		return iface.Manager.AddPeer(publicKey, preshared, []net.IPNet{allowedNet})
+	}); err != nil {
+		logger.Error("add peer", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "add peer"})
 		return
 	}
+	undo.add(func() error { return iface.Manager.RemovePeer(publicKey) })
 
 	allowedCIDR := allowedNet.String()
 	now := time.Now().UTC()
@@ -179,139 +353,368 @@ func (s *Server) handleCreatePeer(c *gin.Context) {
 		PresharedKey: presharedString,
 		ClientIPv4:   clientIP,
 		AllowedCIDR:  allowedCIDR,
-		Interface:    s.opts.Interface,
+		Interface:    iface.Name,
+		Owner:        jwtSubject(c),
+		Note:         req.Note,
 		CreatedAt:    now,
 	}
-	s.opts.PeerStore.Add(peer)
+	if err := traced(ctx, "store.Add", func() error { return s.opts.PeerStore.Add(peer) }); err != nil {
+		logger.Error("store peer", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "store peer"})
+		return
+	}
+	undo.add(func() error {
+		_, err := s.opts.PeerStore.Delete(peerID)
+		return err
+	})
 
-	data := map[string]any{
-		"PeerID":           peerID,
-		"Interface":        s.opts.Interface,
-		"ClientIPv4":       clientIP.String(),
-		"PeerPublicKey":    publicKey.String(),
-		"PeerPrivateKey":   privateKey.String(),
-		"PresharedKey":     presharedString,
-		"AllowedIPs":       allowedCIDR,
-		"Endpoint":         s.opts.Endpoint,
-		"CreatedAt":        now,
-		"CreatedAtRFC3339": now.Format(time.RFC3339),
-		"Note":             req.Note,
+	contentType, body, err := s.renderPeer(c.Request.Context(), format, iface, renderer, peer, jwtClaims(c))
+	if err != nil {
+		renderFailed(c, logger, err)
+		return
 	}
 
-	rendered, err := s.opts.Renderer.Render(data)
+	committed = true
+	logger.Info("peer created", "allowed_ips", allowedCIDR)
+	s.recordAudit(c, audit.Event{Action: audit.ActionPeerCreated, PeerID: peer.ID, Interface: iface.Name})
+	s.opts.Events.Publish(events.Event{Type: events.PeerCreated, PeerID: peer.ID, Interface: iface.Name, Owner: peer.Owner})
+	c.Data(http.StatusCreated, contentType, body)
+}
+
+// refreshInfo caches the interface's public key, listen port and MTU.
+func (s *Server) refreshInfo(iface *Interface) error {
+	info, err := iface.Manager.Info()
 	if err != nil {
-		log.Printf("render template: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "template render failed"})
+		return fmt.Errorf("read interface %s: %w", iface.Name, err)
+	}
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.info[iface.Name] = info
+	return nil
+}
+
+// deviceInfo returns the cached device values for an interface.
+func (s *Server) deviceInfo(name string) wg.DeviceInfo {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.info[name]
+}
+
+// SampleTemplateData returns template values for a made-up peer. Renderers
+// dry-run new templates against it.
+func SampleTemplateData() map[string]any {
+	iface := &Interface{Name: "wg0", Endpoint: "vpn.example.com:51820"}
+	return templateData(iface, samplePeer(iface.Name), wg.DeviceInfo{ListenPort: 51820, MTU: 1420}, sampleClaims())
+}
+
+func samplePeer(iface string) *peers.Peer {
+	return &peers.Peer{
+		ID:           "sample",
+		PublicKey:    wgtypes.Key{}.String(),
+		PrivateKey:   wgtypes.Key{}.String(),
+		PresharedKey: wgtypes.Key{}.String(),
+		ClientIPv4:   net.IPv4(192, 0, 2, 1),
+		AllowedCIDR:  "192.0.2.1/32",
+		Interface:    iface,
+		Note:         "sample",
+		CreatedAt:    time.Unix(0, 0).UTC(),
+	}
+}
+
+func sampleClaims() map[string]any {
+	return map[string]any{"sub": "sample"}
+}
+
+// templateData builds the values available to response templates. Claims
+// are the caller's validated JWT claims, if any.
+func templateData(iface *Interface, peer *peers.Peer, info wg.DeviceInfo, claims map[string]any) map[string]any {
+	if claims == nil {
+		claims = map[string]any{}
+	}
+	return map[string]any{
+		"PeerID":           peer.ID,
+		"Interface":        iface.Name,
+		"ClientIPv4":       peer.ClientIPv4.String(),
+		"PeerPublicKey":    peer.PublicKey,
+		"PeerPrivateKey":   peer.PrivateKey,
+		"PresharedKey":     peer.PresharedKey,
+		"AllowedIPs":       peer.AllowedCIDR,
+		"Endpoint":         clientEndpoint(iface, info),
+		"ServerPublicKey":  info.PublicKey.String(),
+		"ListenPort":       info.ListenPort,
+		"MTU":              info.MTU,
+		"CreatedAt":        peer.CreatedAt,
+		"CreatedAtRFC3339": peer.CreatedAt.Format(time.RFC3339),
+		"Note":             peer.Note,
+		"Claims":           claims,
+	}
+}
+
+// selectInterface resolves the interface for a new peer from the JWT claim,
+// the request body or the default. A claim takes precedence and a request
+// that asks for a different interface is rejected.
+func (s *Server) selectInterface(c *gin.Context, requested string) (*Interface, int, string) {
+	name := requested
+	if claimed, ok := jwtClaims(c)[InterfaceClaim].(string); ok && claimed != "" {
+		if requested != "" && requested != claimed {
+			return nil, http.StatusForbidden, "interface not permitted"
+		}
+		name = claimed
+	}
+	if name == "" {
+		return &s.opts.Interfaces[0], 0, ""
+	}
+	iface, ok := s.interfaces[name]
+	if !ok {
+		return nil, http.StatusBadRequest, "unknown interface"
+	}
+	return iface, 0, ""
+}
+
+func (s *Server) handleGetPeerConfig(c *gin.Context) {
+	format, ok := negotiateFormat(c)
+	if !ok {
+		badFormat(c)
 		return
 	}
 
-	c.Data(http.StatusCreated, "application/json", []byte(rendered))
+	// During a server key rotation fetching the config moves the peer, which
+	// must not interleave with a rotation or removal of its key.
+	unlock := s.opts.PeerStore.Lock(c.Param("id"))
+	defer unlock()
+	peer, err := tracedValue(c.Request.Context(), "store.Get", func() (*peers.Peer, error) {
+		return s.opts.PeerStore.Get(c.Param("id"))
+	})
+	if err != nil || !canAccessPeer(c, peer.Owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+		return
+	}
+	iface, ok := s.interfaces[peer.Interface]
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unknown interface"})
+		return
+	}
+	renderer, ok := s.selectTemplate(c, iface, c.Query("template"))
+	if !ok {
+		unknownTemplate(c)
+		return
+	}
+
+	logger := requestLog(c).With("peer_id", peer.ID)
+	contentType, body, err := s.renderPeer(c.Request.Context(), format, iface, renderer, peer, jwtClaims(c))
+	if err != nil {
+		renderFailed(c, logger, err)
+		return
+	}
+	if iface.Rotator != nil {
+		if err := s.movePeer(c.Request.Context(), iface, peer); err != nil {
+			logger.Error("move peer to rotated key", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "move peer"})
+			return
+		}
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// movePeer places a peer whose config now carries the interface's newest
+// key on the device serving that key.
+func (s *Server) movePeer(ctx context.Context, iface *Interface, peer *peers.Peer) error {
+	key, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	return traced(ctx, "wg.MovePeer", func() error { return iface.Rotator.MovePeer(key) })
 }
 
 func (s *Server) handleDeletePeer(c *gin.Context) {
 	id := c.Param("id")
-	peer, err := s.opts.PeerStore.Delete(id)
+	unlock := s.opts.PeerStore.Lock(id)
+	defer unlock()
+	peer, err := tracedValue(c.Request.Context(), "store.Get", func() (*peers.Peer, error) {
+		return s.opts.PeerStore.Get(id)
+	})
 	if err != nil {
 		if errors.Is(err, peers.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete peer"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "load peer"})
 		return
 	}
 
-	key, err := wgtypes.ParseKey(peer.PublicKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "parse public key"})
+	iface, ok := s.interfaces[peer.Interface]
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unknown interface"})
 		return
 	}
 
-	if err := s.opts.Manager.RemovePeer(key); err != nil {
-		log.Printf("remove peer: %v", err)
+	// Retired keys still in their overlap go with the peer.
+	keys := make([]wgtypes.Key, 0, 1+len(peer.RetiredKeys))
+	for _, publicKey := range peer.PublicKeys() {
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "parse public key"})
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	logger := requestLog(c).With("peer_id", peer.ID, "interface", iface.Name)
+	if err := traced(c.Request.Context(), "wg.RemovePeers", func() error { return iface.Manager.RemovePeers(keys) }); err != nil {
+		logger.Error("remove peer", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "remove peer"})
 		return
 	}
 
+	// The peer is only forgotten once it is off the device, so that a
+	// failed removal can be retried.
+	_, err = tracedValue(c.Request.Context(), "store.Delete", func() (*peers.Peer, error) {
+		return s.opts.PeerStore.Delete(id)
+	})
+	if err != nil && !errors.Is(err, peers.ErrNotFound) {
+		logger.Error("delete peer", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete peer"})
+		return
+	}
+
+	if iface.Pool != nil {
+		releasePeerAddress(logger, iface.Pool, peer)
+	}
+	logger.Info("peer deleted")
+	s.recordAudit(c, audit.Event{Action: audit.ActionPeerDeleted, PeerID: peer.ID, Interface: iface.Name})
+	s.opts.Events.Publish(events.Event{Type: events.PeerDeleted, PeerID: peer.ID, Interface: iface.Name, Owner: peer.Owner})
+
 	c.Status(http.StatusNoContent)
 }
 
 func (s *Server) handleReloadTemplate(c *gin.Context) {
-	if err := s.opts.Renderer.Reload(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Every template is reloaded even when an earlier one fails, so that a
+	// single request reports all of the failures.
+	var errs []error
+	reloaded := make(map[*templater.Renderer]bool, len(s.opts.Interfaces))
+	for _, iface := range s.opts.Interfaces {
+		if reloaded[iface.Renderer] {
+			continue
+		}
+		if err := iface.Renderer.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+		reloaded[iface.Renderer] = true
+	}
+	if s.opts.Templates != nil {
+		if err := s.opts.Templates.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		s.reloadFailed(c, errs)
 		return
 	}
+	s.recordAudit(c, audit.Event{Action: audit.ActionTemplateReloaded})
 	c.Status(http.StatusNoContent)
 }
 
-func requestLogger() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		start := time.Now()
-		c.Next()
-		latency := time.Since(start)
-		status := c.Writer.Status()
-		log.Printf("%s %s -> %d (%s)", c.Request.Method, c.Request.URL.Path, status, latency)
-	}
+// reloadFailure describes a template that could not be reloaded.
+type reloadFailure struct {
+	Template string `json:"template"`
+	Error    string `json:"error"`
 }
 
-type createPeerRequest struct {
-	Note string `json:"note"`
+// reloadFailed reports the templates that could not be reloaded. When
+// every failure is a template rejected by its dry run, the request is the
+// caller's mistake.
+func (s *Server) reloadFailed(c *gin.Context, errs []error) {
+	err := errors.Join(errs...)
+	s.recordAudit(c, audit.Event{Action: audit.ActionTemplateReloaded, Reason: err.Error()})
+
+	status := http.StatusUnprocessableEntity
+	var failures []reloadFailure
+	for _, err := range flattenErrors(errs) {
+		if !errors.Is(err, templater.ErrInvalidTemplate) {
+			status = http.StatusInternalServerError
+		}
+		failure := reloadFailure{Error: err.Error()}
+		var loadErr *templater.LoadError
+		if errors.As(err, &loadErr) {
+			failure.Template, failure.Error = loadErr.Path, loadErr.Err.Error()
+		}
+		failures = append(failures, failure)
+	}
+	c.JSON(status, gin.H{"error": "template reload failed", "failures": failures})
 }
 
-func requireBasicAuth(username, password string) gin.HandlerFunc {
-	expected := username + ":" + password
-
-	return func(c *gin.Context) {
-		header := c.GetHeader("Authorization")
-		const prefix = "Basic "
-		if !strings.HasPrefix(header, prefix) {
-			unauthorizedBasic(c)
-			return
+// flattenErrors expands errors joined with errors.Join.
+func flattenErrors(errs []error) []error {
+	var out []error
+	for _, err := range errs {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			out = append(out, flattenErrors(joined.Unwrap())...)
+			continue
 		}
+		out = append(out, err)
+	}
+	return out
+}
 
-		decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
-		if err != nil {
-			unauthorizedBasic(c)
-			return
-		}
+func (s *Server) handleRotateServerKey(c *gin.Context) {
+	iface, ok := s.interfaces[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "interface not found"})
+		return
+	}
+	if iface.Rotator == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "key rotation not configured"})
+		return
+	}
 
-		if subtle.ConstantTimeCompare(decoded, []byte(expected)) != 1 {
-			unauthorizedBasic(c)
+	rotation, err := tracedValue(c.Request.Context(), "wg.RotateServerKey", iface.Rotator.Rotate)
+	if err != nil {
+		if errors.Is(err, wg.ErrRotationInProgress) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
 		}
+		requestLog(c).Error("rotate server key", "interface", iface.Name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "rotate server key"})
+		return
+	}
 
-		c.Next()
+	if err := s.refreshInfo(iface); err != nil {
+		requestLog(c).Error("refresh interface info after rotation", "interface", iface.Name, "error", err)
 	}
-}
 
-func unauthorizedBasic(c *gin.Context) {
-	c.Header("WWW-Authenticate", "Basic realm=\"restricted\"")
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-	c.Abort()
+	requestLog(c).Info("server key rotated",
+		"interface", iface.Name,
+		"overlap_interface", rotation.OverlapInterface,
+		"overlap_listen_port", rotation.OverlapListenPort,
+		"overlap_until", rotation.OverlapUntil.Format(time.RFC3339),
+	)
+	s.recordAudit(c, audit.Event{Action: audit.ActionServerKeyRotated, Interface: iface.Name})
+	c.JSON(http.StatusOK, gin.H{
+		"interface":           iface.Name,
+		"public_key":          rotation.PublicKey.String(),
+		"previous_public_key": rotation.PreviousPublicKey.String(),
+		"overlap_interface":   rotation.OverlapInterface,
+		"overlap_listen_port": rotation.OverlapListenPort,
+		"overlap_until":       rotation.OverlapUntil.Format(time.RFC3339),
+	})
 }
 
-func requireJWTAuth(secret string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		header := c.GetHeader("Authorization")
-		const prefix = "Bearer "
-		if !strings.HasPrefix(header, prefix) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			c.Abort()
-			return
+// releasePeerAddress returns the pool-assigned addresses of a peer and its
+// retired keys to the pool.
+func releasePeerAddress(logger *slog.Logger, pool *ipam.Pool, peer *peers.Peer) {
+	for _, cidr := range peer.AllowedCIDRs() {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err == nil {
+			err = pool.Release(ip)
 		}
-
-		tokenStr := header[len(prefix):]
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(secret), nil
-		})
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			c.Abort()
-			return
+		if err != nil {
+			logger.Error("release address", "peer_id", peer.ID, "error", err)
 		}
-
-		c.Next()
 	}
 }
+
+type createPeerRequest struct {
+	Note      string `json:"note"`
+	Interface string `json:"interface"`
+	Template  string `json:"template"`
+}
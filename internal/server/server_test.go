@@ -1,82 +1,109 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/example/wireguard-gateway/internal/audit"
+	"github.com/example/wireguard-gateway/internal/events"
+	"github.com/example/wireguard-gateway/internal/gc"
+	"github.com/example/wireguard-gateway/internal/ipam"
 	"github.com/example/wireguard-gateway/internal/peers"
 	templater "github.com/example/wireguard-gateway/internal/template"
+	"github.com/example/wireguard-gateway/internal/wg"
 )
 
-type stubManager struct {
-	added   int
-	removed int
-}
-
-func (m *stubManager) AddPeer(publicKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error {
-	m.added++
-	return nil
-}
-
-func (m *stubManager) RemovePeer(publicKey wgtypes.Key) error {
-	m.removed++
-	return nil
-}
-
-func (m *stubManager) Handshakes() (map[string]time.Time, error) {
-	return map[string]time.Time{}, nil
-}
+const testJWTSecret = "test-secret"
 
-func TestCreatePeerIPv6Forbidden(t *testing.T) {
-	dir := t.TempDir()
-	tplPath := filepath.Join(dir, "resp.tmpl")
-	if err := os.WriteFile(tplPath, []byte(`{"ok":true}`), 0o600); err != nil {
+func newTestRenderer(t *testing.T, content string) *templater.Renderer {
+	t.Helper()
+	tplPath := filepath.Join(t.TempDir(), "resp.tmpl")
+	if err := os.WriteFile(tplPath, []byte(content), 0o600); err != nil {
 		t.Fatalf("write template: %v", err)
 	}
-
-	renderer, err := templater.NewRenderer(tplPath)
+	renderer, err := templater.NewJSONRenderer(tplPath, templater.Options{})
 	if err != nil {
 		t.Fatalf("renderer: %v", err)
 	}
+	return renderer
+}
 
-	store := peers.NewStore()
-	mgr := &stubManager{}
-
-	const jwtSecret = "test-secret"
+func newTestServer(t *testing.T, store *peers.Store, interfaces ...Interface) *Server {
+	t.Helper()
 	srv, err := New(Options{
-		ListenAddr:             "",
-		Interface:              "wg0",
-		Endpoint:               "example.com:51820",
-		Renderer:               renderer,
+		Interfaces:             interfaces,
 		PeerStore:              store,
-		Manager:                mgr,
 		TrustProxyLoopbackOnly: true,
 		BasicAuthUsername:      "user",
 		BasicAuthPassword:      "pass",
-		JWTSecret:              jwtSecret,
+		JWTSecret:              testJWTSecret,
 	})
 	if err != nil {
 		t.Fatalf("New server: %v", err)
 	}
+	return srv
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "test"})
-	signed, err := token.SignedString([]byte(jwtSecret))
+func signToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
 	if err != nil {
 		t.Fatalf("sign token: %v", err)
 	}
+	return signed
+}
+
+func createPeer(t *testing.T, srv *Server, remoteAddr, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/peer", strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreatePeerIPv6Forbidden(t *testing.T) {
+	renderer := newTestRenderer(t, `{"ok":true}`)
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: renderer,
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+	})
 
 	req := httptest.NewRequest(http.MethodPost, "/peer", nil)
 	req.RemoteAddr = "[2001:db8::1]:12345"
-	req.Header.Set("Authorization", "Bearer "+signed)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.MapClaims{"sub": "test"}))
 	rr := httptest.NewRecorder()
 
 	srv.Handler().ServeHTTP(rr, req)
@@ -88,7 +115,1718 @@ func TestCreatePeerIPv6Forbidden(t *testing.T) {
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Fatalf("expected body %s, got %s", expected, rr.Body.String())
 	}
-	if mgr.added != 0 {
+	if len(device.Configs()) != 0 {
 		t.Fatalf("expected AddPeer not called")
 	}
 }
+
+func TestCreatePeerInterfaceFromClaim(t *testing.T) {
+	renderer := newTestRenderer(t, `{"interface":"{{ .Interface }}","allowed_ips":"{{ .AllowedIPs }}"}`)
+
+	pool, err := ipam.NewPool("10.8.0.0/24")
+	if err != nil {
+		t.Fatalf("pool: %v", err)
+	}
+
+	store := peers.NewStore()
+	defaultDevice := wg.NewFakeDevice("wg0")
+	poolDevice := wg.NewFakeDevice("wg1")
+
+	srv := newTestServer(t, store,
+		Interface{Name: "wg0", Endpoint: "example.com:51820", Renderer: renderer, Manager: wg.NewManagerWithClient(defaultDevice, "wg0", 0)},
+		Interface{Name: "wg1", Endpoint: "example.com:51821", Renderer: renderer, Manager: wg.NewManagerWithClient(poolDevice, "wg1", 0), Pool: pool},
+	)
+
+	token := signToken(t, jwt.MapClaims{"sub": "test", InterfaceClaim: "wg1"})
+
+	rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	expected := `{"interface":"wg1","allowed_ips":"10.8.0.1/32"}`
+	if rr.Body.String() != expected {
+		t.Fatalf("expected body %s, got %s", expected, rr.Body.String())
+	}
+	if len(defaultDevice.Peers()) != 0 || len(poolDevice.Peers()) != 1 {
+		t.Fatalf("expected peer on wg1 only, got wg0=%d wg1=%d", len(defaultDevice.Peers()), len(poolDevice.Peers()))
+	}
+
+	rr = createPeer(t, srv, "192.0.2.10:12345", token, `{"interface":"wg0"}`)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d for conflicting interface, got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestPeerLifecycle(t *testing.T) {
+	renderer := newTestRenderer(t, `{"peer_id":"{{ .PeerID }}","public_key":"{{ .PeerPublicKey }}"}`)
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 25)
+
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: renderer,
+		Manager:  mgr,
+	})
+	collector := gc.New(gc.Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: 10 * time.Minute,
+		StaleHandshakeTTL: 24 * time.Hour,
+	})
+
+	token := signToken(t, jwt.MapClaims{"sub": "test"})
+	var created [2]struct {
+		PeerID    string `json:"peer_id"`
+		PublicKey string `json:"public_key"`
+	}
+	for i := range created {
+		rr := createPeer(t, srv, fmt.Sprintf("192.0.2.%d:12345", 10+i), token, "")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("create peer: status %d: %s", rr.Code, rr.Body.String())
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &created[i]); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+	}
+
+	stalePub, err := wgtypes.ParseKey(created[0].PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	devicePeer, ok := device.Peer(stalePub)
+	if !ok {
+		t.Fatalf("expected peer on device")
+	}
+	if devicePeer.PersistentKeepaliveInterval != 25*time.Second {
+		t.Fatalf("expected keepalive 25s, got %s", devicePeer.PersistentKeepaliveInterval)
+	}
+	if len(devicePeer.AllowedIPs) != 1 || devicePeer.AllowedIPs[0].String() != "192.0.2.10/32" {
+		t.Fatalf("unexpected allowed ips %v", devicePeer.AllowedIPs)
+	}
+
+	if err := device.Handshake(stalePub, time.Now(), nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	collector.RunOnce(context.Background(), audit.ActorSystem)
+	stored, err := store.Get(created[0].PeerID)
+	if err != nil {
+		t.Fatalf("expected connected peer kept: %v", err)
+	}
+	if stored.LastHandshakeAt == nil {
+		t.Fatalf("expected handshake recorded in store")
+	}
+
+	if err := device.Handshake(stalePub, time.Now().Add(-25*time.Hour), nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	collector.RunOnce(context.Background(), audit.ActorSystem)
+	if _, err := store.Get(created[0].PeerID); !errors.Is(err, peers.ErrNotFound) {
+		t.Fatalf("expected stale peer collected, got err %v", err)
+	}
+	if _, ok := device.Peer(stalePub); ok {
+		t.Fatalf("expected stale peer removed from device")
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/peer/"+created[1].PeerID, nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if len(device.Peers()) != 0 {
+		t.Fatalf("expected device empty, got %d peers", len(device.Peers()))
+	}
+	if len(store.List()) != 0 {
+		t.Fatalf("expected store empty, got %d peers", len(store.List()))
+	}
+}
+
+func TestDeletePeerDeviceFailure(t *testing.T) {
+	renderer := newTestRenderer(t, `{"peer_id":"{{ .PeerID }}"}`)
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: renderer,
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+	})
+
+	rr := createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "test"}), "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	var created struct {
+		PeerID string `json:"peer_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	device.FailNext(wg.FakeOpConfigure, errors.New("netlink busy"))
+	req := httptest.NewRequest(http.MethodDelete, "/peer/"+created.PeerID, nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if _, err := store.Get(created.PeerID); err != nil {
+		t.Fatalf("expected peer to remain in store: %v", err)
+	}
+	if got := len(device.Peers()); got != 1 {
+		t.Fatalf("expected peer to remain on device, got %d peers", got)
+	}
+
+	// The failed delete can be retried.
+	req = httptest.NewRequest(http.MethodDelete, "/peer/"+created.PeerID, nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("retry delete: status %d", rr.Code)
+	}
+	if _, err := store.Get(created.PeerID); !errors.Is(err, peers.ErrNotFound) {
+		t.Fatalf("expected peer to be deleted from store, got %v", err)
+	}
+	if got := len(device.Peers()); got != 0 {
+		t.Fatalf("expected no peers on device, got %d", got)
+	}
+}
+
+func TestCreatePeerRollback(t *testing.T) {
+	token := signToken(t, jwt.MapClaims{"sub": "test"})
+
+	newServer := func(t *testing.T, tpl string, poolCIDR string) (*Server, *peers.Store, *wg.FakeDevice, *ipam.Pool) {
+		t.Helper()
+		pool, err := ipam.NewPool(poolCIDR)
+		if err != nil {
+			t.Fatalf("pool: %v", err)
+		}
+		store := peers.NewStore()
+		device := wg.NewFakeDevice("wg0")
+		srv := newTestServer(t, store, Interface{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, tpl),
+			Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+			Pool:     pool,
+		})
+		return srv, store, device, pool
+	}
+
+	// assertReleased checks that both addresses of the /30 pool are free.
+	assertReleased := func(t *testing.T, pool *ipam.Pool) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if _, err := pool.Allocate(); err != nil {
+				t.Fatalf("expected address released, got %v", err)
+			}
+		}
+	}
+
+	t.Run("pool exhausted", func(t *testing.T) {
+		srv, store, device, pool := newServer(t, `{}`, "10.9.0.0/30")
+		for i := 0; i < 2; i++ {
+			if _, err := pool.Allocate(); err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+		}
+		rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+		if len(device.Configs()) != 0 || len(store.List()) != 0 {
+			t.Fatalf("expected no device or store changes")
+		}
+	})
+
+	t.Run("device failure", func(t *testing.T) {
+		srv, store, device, pool := newServer(t, `{}`, "10.9.0.0/30")
+		device.FailNext(wg.FakeOpConfigure, errors.New("netlink busy"))
+		rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+		if len(device.Peers()) != 0 || len(store.List()) != 0 {
+			t.Fatalf("expected no device peers or stored peers")
+		}
+		assertReleased(t, pool)
+	})
+
+	t.Run("store failure", func(t *testing.T) {
+		srv, store, device, pool := newServer(t, `{}`, "10.9.0.0/30")
+		srv.newPeerID = func() string { return "taken" }
+		if err := store.Add(&peers.Peer{ID: "taken", Interface: "wg0"}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+		if len(device.Peers()) != 0 {
+			t.Fatalf("expected device peer rolled back, got %d peers", len(device.Peers()))
+		}
+		if len(store.List()) != 1 {
+			t.Fatalf("expected existing peer untouched, got %d peers", len(store.List()))
+		}
+		assertReleased(t, pool)
+	})
+
+	t.Run("render failure", func(t *testing.T) {
+		srv, store, device, pool := newServer(t, `{"note":"{{ call .Note }}"}`, "10.9.0.0/30")
+		rr := createPeer(t, srv, "192.0.2.10:12345", token, `{"note":"x"}`)
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+		if len(device.Peers()) != 0 || len(store.List()) != 0 {
+			t.Fatalf("expected device and store rolled back")
+		}
+		assertReleased(t, pool)
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		srv, store, device, pool := newServer(t, `{"note":{{ .Note }}}`, "10.9.0.0/30")
+		rr := createPeer(t, srv, "192.0.2.10:12345", token, `{"note":"x"}`)
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+		if expected := `{"error":"template produced invalid JSON"}`; rr.Body.String() != expected {
+			t.Fatalf("expected body %s, got %s", expected, rr.Body.String())
+		}
+		if len(device.Peers()) != 0 || len(store.List()) != 0 {
+			t.Fatalf("expected device and store rolled back")
+		}
+		assertReleased(t, pool)
+	})
+}
+
+func TestRotateServerKey(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	if err := mgr.Bootstrap(wg.InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	overlapDevice := wg.NewFakeDevice("wg0-next")
+	rotator := wg.NewKeyRotator(mgr, wg.RotationConfig{
+		OverlapInterface:  "wg0-next",
+		OverlapListenPort: 51900,
+		Grace:             time.Hour,
+		NewOverlap: func() (*wg.Manager, error) {
+			return wg.NewManagerWithClient(overlapDevice, "wg0-next", 0), nil
+		},
+	})
+	defer rotator.Close()
+
+	// The public ports are mapped and differ from the listen ports.
+	srv := newTestServer(t, store, Interface{
+		Name:              "wg0",
+		Endpoint:          "example.com:443",
+		Renderer:          newTestRenderer(t, `{"peer_id":"{{ .PeerID }}","server_public_key":"{{ .ServerPublicKey }}","endpoint":"{{ .Endpoint }}"}`),
+		Manager:           rotator,
+		Rotator:           rotator,
+		OverlapEndpoint:   "example.com:8443",
+		OverlapListenPort: 51900,
+	})
+	token := signToken(t, jwt.MapClaims{"sub": "test"})
+
+	rotate := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/interfaces/wg0/rotate-key", nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+	type peerConfig struct {
+		PeerID          string `json:"peer_id"`
+		ServerPublicKey string `json:"server_public_key"`
+		Endpoint        string `json:"endpoint"`
+	}
+	decode := func(rr *httptest.ResponseRecorder) peerConfig {
+		t.Helper()
+		var cfg peerConfig
+		if err := json.Unmarshal(rr.Body.Bytes(), &cfg); err != nil {
+			t.Fatalf("decode config: %v", err)
+		}
+		return cfg
+	}
+
+	rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	existing := decode(rr)
+	if existing.Endpoint != "example.com:443" {
+		t.Fatalf("expected the configured endpoint outside a rotation, got %+v", existing)
+	}
+	existingPeer, err := store.Get(existing.PeerID)
+	if err != nil {
+		t.Fatalf("get peer: %v", err)
+	}
+	existingKey, err := wgtypes.ParseKey(existingPeer.PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+
+	rr = rotate()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var rotation struct {
+		PublicKey         string `json:"public_key"`
+		OverlapListenPort int    `json:"overlap_listen_port"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &rotation); err != nil {
+		t.Fatalf("decode rotation: %v", err)
+	}
+	if rotation.OverlapListenPort != 51900 {
+		t.Fatalf("expected overlap port 51900, got %d", rotation.OverlapListenPort)
+	}
+	if _, ok := device.Peer(existingKey); !ok {
+		t.Fatalf("expected existing peer to stay on the previous key")
+	}
+
+	rr = createPeer(t, srv, "192.0.2.11:12345", token, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	if cfg := decode(rr); cfg.ServerPublicKey != rotation.PublicKey || cfg.Endpoint != "example.com:8443" {
+		t.Fatalf("expected new key and overlap endpoint, got %+v", cfg)
+	}
+	if got := len(overlapDevice.Peers()); got != 1 {
+		t.Fatalf("expected new peer on overlap interface, got %d peers", got)
+	}
+
+	// Fetching a config for the new key moves an existing peer over, once
+	// no other change to the peer holds its lock.
+	unlock := store.Lock(existing.PeerID)
+	fetched := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/peer/"+existing.PeerID+"/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		fetched <- rr
+	}()
+	select {
+	case <-fetched:
+		t.Fatalf("expected the config fetch to wait for the peer lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := overlapDevice.Peer(existingKey); ok {
+		t.Fatalf("expected the peer not moved while locked")
+	}
+	unlock()
+	rr = <-fetched
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get config: status %d: %s", rr.Code, rr.Body.String())
+	}
+	if cfg := decode(rr); cfg.ServerPublicKey != rotation.PublicKey || cfg.Endpoint != "example.com:8443" {
+		t.Fatalf("expected new key and overlap endpoint, got %+v", cfg)
+	}
+	if _, ok := overlapDevice.Peer(existingKey); !ok {
+		t.Fatalf("expected existing peer moved to overlap interface")
+	}
+	if _, ok := device.Peer(existingKey); ok {
+		t.Fatalf("expected existing peer removed from previous key")
+	}
+
+	if rr := rotate(); rr.Code != http.StatusConflict {
+		t.Fatalf("expected status %d during overlap, got %d", http.StatusConflict, rr.Code)
+	}
+}
+
+func TestRotatePeerKey(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	pool, err := ipam.NewPool("10.8.0.0/24")
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"peer_id":"{{ .PeerID }}","public_key":"{{ .PeerPublicKey }}","note":"{{ .Note }}"}`),
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+		Pool:     pool,
+	})
+
+	owner := signToken(t, jwt.MapClaims{"sub": "alice"})
+	rr := createPeer(t, srv, "192.0.2.10:12345", owner, `{"note":"laptop"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	var created struct {
+		PeerID    string `json:"peer_id"`
+		PublicKey string `json:"public_key"`
+		Note      string `json:"note"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	oldKey, err := wgtypes.ParseKey(created.PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+
+	rotate := func(auth func(*http.Request), body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/peer/"+created.PeerID+"/rotate", strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		auth(req)
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	if rr := rotate(bearer(signToken(t, jwt.MapClaims{"sub": "mallory"})), ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d for non-owner, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	rr = rotate(bearer(owner), "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var rotated struct {
+		PeerID    string `json:"peer_id"`
+		PublicKey string `json:"public_key"`
+		Note      string `json:"note"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &rotated); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if rotated.PeerID != created.PeerID || rotated.PublicKey == created.PublicKey || rotated.Note != "laptop" {
+		t.Fatalf("unexpected rotated response %+v", rotated)
+	}
+	newKey, err := wgtypes.ParseKey(rotated.PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	if _, ok := device.Peer(oldKey); ok {
+		t.Fatalf("expected old key removed without overlap")
+	}
+	if peer, ok := device.Peer(newKey); !ok || len(peer.AllowedIPs) != 1 {
+		t.Fatalf("expected new key to own the allowed ip, got %+v", peer)
+	}
+	stored, err := store.Get(created.PeerID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stored.PublicKey != rotated.PublicKey {
+		t.Fatalf("expected store updated")
+	}
+
+	rr = rotate(func(req *http.Request) { req.SetBasicAuth("user", "pass") }, `{"overlap_seconds":60}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d for admin, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &rotated); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	overlapKey, err := wgtypes.ParseKey(rotated.PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	// Both keys stay routable during the overlap, each with its own address.
+	previous, ok := device.Peer(newKey)
+	if !ok || len(previous.AllowedIPs) != 1 || previous.AllowedIPs[0].String() != stored.AllowedCIDR {
+		t.Fatalf("expected previous key to keep %s during overlap, got %+v", stored.AllowedCIDR, previous)
+	}
+	next, ok := device.Peer(overlapKey)
+	if !ok || len(next.AllowedIPs) != 1 || next.AllowedIPs[0].String() == stored.AllowedCIDR {
+		t.Fatalf("expected new key on a distinct address, got %+v", next)
+	}
+	overlapped, err := store.Get(created.PeerID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if overlapped.AllowedCIDR != next.AllowedIPs[0].String() {
+		t.Fatalf("expected store to hold the new address, got %s", overlapped.AllowedCIDR)
+	}
+	if len(overlapped.RetiredKeys) != 1 || overlapped.RetiredKeys[0].PublicKey != stored.PublicKey || overlapped.RetiredKeys[0].AllowedCIDR != stored.AllowedCIDR {
+		t.Fatalf("expected previous key retired, got %+v", overlapped.RetiredKeys)
+	}
+
+	device.FailNext(wg.FakeOpConfigure, errors.New("netlink busy"))
+	before, _ := store.Get(created.PeerID)
+	if rr := rotate(bearer(owner), ""); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d on device failure, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	after, _ := store.Get(created.PeerID)
+	if after.PublicKey != before.PublicKey {
+		t.Fatalf("expected store untouched after failed rotation")
+	}
+}
+
+func TestRotatePeerKeyOverlapRequiresPool(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"peer_id":"{{ .PeerID }}"}`),
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+	})
+
+	owner := signToken(t, jwt.MapClaims{"sub": "alice"})
+	rr := createPeer(t, srv, "192.0.2.10:12345", owner, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	var created struct {
+		PeerID string `json:"peer_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/peer/"+created.PeerID+"/rotate", strings.NewReader(`{"overlap_seconds":60}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+owner)
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, rr.Code)
+	}
+	if peers := device.Peers(); len(peers) != 1 {
+		t.Fatalf("expected device unchanged, got %d peers", len(peers))
+	}
+}
+
+func TestRotatePeerKeyConcurrent(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"peer_id":"{{ .PeerID }}"}`),
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+	})
+
+	owner := signToken(t, jwt.MapClaims{"sub": "alice"})
+	rr := createPeer(t, srv, "192.0.2.10:12345", owner, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	var created struct {
+		PeerID string `json:"peer_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	var done sync.WaitGroup
+	for range 8 {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			req := httptest.NewRequest(http.MethodPost, "/peer/"+created.PeerID+"/rotate", nil)
+			req.Header.Set("Authorization", "Bearer "+owner)
+			rr := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+			}
+		}()
+	}
+	done.Wait()
+
+	// Every rotation replaced the key the previous one installed.
+	stored, err := store.Get(created.PeerID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	devicePeers := device.Peers()
+	if len(devicePeers) != 1 || devicePeers[0].PublicKey.String() != stored.PublicKey {
+		t.Fatalf("expected only the stored key on the device, got %d peers", len(devicePeers))
+	}
+}
+
+func TestPeerConfigWGQuick(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	if err := mgr.Bootstrap(wg.InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	info, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	srv := newTestServer(t, store, Interface{
+		Name:                       "wg0",
+		Endpoint:                   "example.com:51820",
+		Renderer:                   newTestRenderer(t, `{"peer_id":"{{ .PeerID }}"}`),
+		Manager:                    mgr,
+		ClientDNS:                  []string{"1.1.1.1"},
+		PersistentKeepaliveSeconds: 25,
+	})
+
+	owner := signToken(t, jwt.MapClaims{"sub": "alice"})
+	req := httptest.NewRequest(http.MethodPost, "/peer?format=wg-quick", nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	req.Header.Set("Authorization", "Bearer "+owner)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("expected text/plain, got %s", ct)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"[Interface]\n",
+		"Address = 192.0.2.10/32\n",
+		"DNS = 1.1.1.1\n",
+		"[Peer]\n",
+		"PublicKey = " + info.PublicKey.String() + "\n",
+		"Endpoint = example.com:51820\n",
+		"AllowedIPs = 0.0.0.0/0\n",
+		"PersistentKeepalive = 25\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in config:\n%s", want, body)
+		}
+	}
+
+	peerList := store.List()
+	if len(peerList) != 1 {
+		t.Fatalf("expected one stored peer, got %d", len(peerList))
+	}
+	if !strings.Contains(body, "PrivateKey = "+peerList[0].PrivateKey+"\n") {
+		t.Fatalf("expected peer private key in config:\n%s", body)
+	}
+
+	get := func(token, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/peer/"+peerList[0].ID+"/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = get(owner, "text/plain")
+	if rr.Code != http.StatusOK || rr.Body.String() != body {
+		t.Fatalf("expected stored wg-quick config, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+	rr = get(owner, "")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"peer_id":"`+peerList[0].ID+`"}` {
+		t.Fatalf("expected JSON config by default, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(signToken(t, jwt.MapClaims{"sub": "mallory"}), ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d for non-owner, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestPeerConfigQR(t *testing.T) {
+	store := peers.NewStore()
+	mgr := wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0)
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{}`),
+		Manager:  mgr,
+	})
+	token := signToken(t, jwt.MapClaims{"sub": "alice"})
+	if rr := createPeer(t, srv, "192.0.2.10:12345", token, ""); rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d: %s", rr.Code, rr.Body.String())
+	}
+	peerList := store.List()
+	if len(peerList) != 1 {
+		t.Fatalf("expected one stored peer, got %d", len(peerList))
+	}
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/peer/"+peerList[0].ID+"/config?format=qr", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	rr := get("")
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("expected image/png, got %s", ct)
+	}
+	if !bytes.HasPrefix(rr.Body.Bytes(), []byte("\x89PNG")) {
+		t.Fatalf("expected PNG image")
+	}
+
+	rr = get("text/plain")
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("expected text/plain, got %s", ct)
+	}
+	if !strings.Contains(rr.Body.String(), "█") {
+		t.Fatalf("expected block characters in QR code:\n%s", rr.Body.String())
+	}
+
+	// A config too large for a QR code is reported as such.
+	tooLarge := make([]string, 0, 300)
+	for i := range 300 {
+		tooLarge = append(tooLarge, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+	srv.interfaces["wg0"].ClientAllowedIPs = tooLarge
+	req := httptest.NewRequest(http.MethodGet, "/peer/"+peerList[0].ID+"/config?format=qr", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "QR code encoding failed") {
+		t.Fatalf("expected QR encoding error, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReloadTemplateReportsEveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	newRenderer := func(name string) (*templater.Renderer, string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(`{"peer_id":"{{ .PeerID }}"}`), 0o600); err != nil {
+			t.Fatalf("write template: %v", err)
+		}
+		renderer, err := templater.NewJSONRenderer(path, templater.Options{Sample: SampleTemplateData()})
+		if err != nil {
+			t.Fatalf("renderer: %v", err)
+		}
+		return renderer, path
+	}
+	first, firstPath := newRenderer("first.json.tmpl")
+	second, secondPath := newRenderer("second.json.tmpl")
+	srv := newTestServer(t, peers.NewStore(),
+		Interface{Name: "wg0", Endpoint: "example.com:51820", Renderer: first, Manager: wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0)},
+		Interface{Name: "wg1", Endpoint: "example.com:51821", Renderer: second, Manager: wg.NewManagerWithClient(wg.NewFakeDevice("wg1"), "wg1", 0)},
+	)
+
+	for _, path := range []string{firstPath, secondPath} {
+		if err := os.WriteFile(path, []byte(`{"peer_id":"{{ .PeerIdd }}"}`), 0o600); err != nil {
+			t.Fatalf("write template: %v", err)
+		}
+	}
+	reload := func() (int, []reloadFailure) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload-template", nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		var resp struct {
+			Failures []reloadFailure `json:"failures"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return rr.Code, resp.Failures
+	}
+
+	status, failures := reload()
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, status)
+	}
+	if len(failures) != 2 || failures[0].Template != firstPath || failures[1].Template != secondPath {
+		t.Fatalf("expected both templates reported, got %+v", failures)
+	}
+	if !strings.Contains(failures[0].Error, "PeerIdd") {
+		t.Fatalf("expected error to name the missing key, got %s", failures[0].Error)
+	}
+
+	// A template that cannot be read is not the caller's mistake.
+	if err := os.Remove(firstPath); err != nil {
+		t.Fatalf("remove template: %v", err)
+	}
+	status, failures = reload()
+	if status != http.StatusInternalServerError || len(failures) != 2 {
+		t.Fatalf("expected status %d with both failures, got %d: %+v", http.StatusInternalServerError, status, failures)
+	}
+}
+
+func TestReloadTemplateValidates(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "..", "templates", "peer_response.json.tmpl"))
+	if err != nil {
+		t.Fatalf("read sample template: %v", err)
+	}
+	tplPath := filepath.Join(t.TempDir(), "resp.tmpl")
+	if err := os.WriteFile(tplPath, content, 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	renderer, err := templater.NewJSONRenderer(tplPath, templater.Options{Sample: SampleTemplateData()})
+	if err != nil {
+		t.Fatalf("renderer: %v", err)
+	}
+	srv := newTestServer(t, peers.NewStore(), Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: renderer,
+		Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+	})
+
+	if err := os.WriteFile(tplPath, []byte(`{"peer_id":"{{ .PeerIdd }}"}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/reload-template", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "PeerIdd") {
+		t.Fatalf("expected error to name the missing key, got %s", rr.Body.String())
+	}
+
+	rr = createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "test"}), "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"server_public_key"`) {
+		t.Fatalf("expected previous template in use, got %s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/metrics", nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	var metrics map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &metrics); err != nil {
+		t.Fatalf("decode metrics: %v", err)
+	}
+	var reloads map[string]int
+	if err := json.Unmarshal(metrics["template_reloads"], &reloads); err != nil {
+		t.Fatalf("decode template_reloads: %v", err)
+	}
+	if reloads["failed"] == 0 {
+		t.Fatalf("expected failed reload in metrics, got %v", reloads)
+	}
+	for _, name := range []string{"cmdline", "memstats"} {
+		if _, ok := metrics[name]; ok {
+			t.Fatalf("expected %s not published", name)
+		}
+	}
+}
+
+func TestCreatePeerNamedTemplate(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"android.json.tmpl": `{"android":"{{ .PeerID }}","sub":"{{ .Claims.sub }}"}`,
+		"windows.conf.tmpl": `windows {{ .PeerID }}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write template: %v", err)
+		}
+	}
+	templates, err := templater.NewSet(dir, templater.Options{Sample: SampleTemplateData()})
+	if err != nil {
+		t.Fatalf("NewSet: %v", err)
+	}
+
+	store := peers.NewStore()
+	pool, err := ipam.NewPool("10.8.0.0/24")
+	if err != nil {
+		t.Fatalf("pool: %v", err)
+	}
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{"default":"{{ .PeerID }}"}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+			Pool:     pool,
+		}},
+		Templates:         templates,
+		PeerStore:         store,
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+
+	create := func(token, accept, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/peer", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.10:12345"
+		req.Header.Set("Authorization", "Bearer "+token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	plain := signToken(t, jwt.MapClaims{"sub": "test"})
+	tenant := signToken(t, jwt.MapClaims{"sub": "test", TemplateClaim: "android"})
+	for _, tc := range []struct {
+		name, token, accept, body string
+		prefix, contentType       string
+	}{
+		{"default", plain, "", "", `{"default":`, "application/json"},
+		{"claim", tenant, "", "", `{"android":`, "application/json"},
+		{"accept", tenant, "text/plain; template=windows", "", "windows ", "text/plain; charset=utf-8"},
+		{"body", tenant, "application/json; template=windows", `{"template":"android"}`, `{"android":`, "application/json"},
+		{"preferred media type", plain, "text/plain, application/json; template=android", "", "[Interface]", "text/plain; charset=utf-8"},
+		{"other media type", plain, "image/png; template=android, application/json", "", `{"default":`, "application/json"},
+	} {
+		rr := create(tc.token, tc.accept, tc.body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: expected status %d, got %d: %s", tc.name, http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		if !strings.HasPrefix(rr.Body.String(), tc.prefix) {
+			t.Fatalf("%s: expected body starting with %s, got %s", tc.name, tc.prefix, rr.Body.String())
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Fatalf("%s: expected content type %s, got %s", tc.name, tc.contentType, ct)
+		}
+		if tc.name == "claim" && !strings.HasSuffix(rr.Body.String(), `"sub":"test"}`) {
+			t.Fatalf("expected caller's claims in response, got %s", rr.Body.String())
+		}
+	}
+
+	before := len(store.List())
+	if rr := create(plain, "", `{"template":"ios"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for unknown template, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if len(store.List()) != before {
+		t.Fatalf("expected no peer created for unknown template")
+	}
+}
+
+func TestCreatePeerIgnoresTemplateClaimWithoutSet(t *testing.T) {
+	srv := newTestServer(t, peers.NewStore(), Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"default":"{{ .PeerID }}"}`),
+		Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+	})
+
+	token := signToken(t, jwt.MapClaims{"sub": "test", TemplateClaim: "android"})
+	rr := createPeer(t, srv, "192.0.2.10:12345", token, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Body.String(), `{"default":`) {
+		t.Fatalf("expected interface template, got %s", rr.Body.String())
+	}
+}
+
+func TestPreviewTemplate(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"peer_id":"{{ .PeerID }}","endpoint":"{{ .Endpoint }}"}`),
+		Manager:  wg.NewManagerWithClient(device, "wg0", 0),
+	})
+
+	preview := func(body string) (int, map[string]string) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/templates/preview", strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		var resp map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := preview("")
+	if code != http.StatusOK || resp["output"] != `{"peer_id":"sample","endpoint":"example.com:51820"}` {
+		t.Fatalf("unexpected preview of active template: %d %v", code, resp)
+	}
+	if resp["content_type"] != "application/json" {
+		t.Fatalf("expected JSON content type, got %s", resp["content_type"])
+	}
+
+	code, resp = preview(`{"body":"note = {{ .Note }} ({{ .Claims.sub }})","text":true,"data":{"Note":"a\"b"}}`)
+	if code != http.StatusOK || resp["output"] != `note = a"b (sample)` {
+		t.Fatalf("unexpected preview of submitted template: %d %v", code, resp)
+	}
+
+	code, resp = preview(`{"body":"{\"id\":\"{{ .PeerIdd }}\"}"}`)
+	if code != http.StatusUnprocessableEntity || !strings.Contains(resp["error"], "PeerIdd") {
+		t.Fatalf("expected render error naming the key, got %d %v", code, resp)
+	}
+
+	if len(device.Configs()) != 0 || len(store.List()) != 0 {
+		t.Fatalf("expected preview to leave device and store untouched")
+	}
+
+	// The preview shows the error of an active template that falls back.
+	fallback, err := templater.NewDefaultRenderer(templater.Options{})
+	if err != nil {
+		t.Fatalf("NewDefaultRenderer: %v", err)
+	}
+	broken, err := templater.Compile(`{"org":"{{ .Claims.org }}"}`, true, templater.Options{Fallback: fallback})
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	srv.interfaces["wg0"].Renderer = broken
+	code, resp = preview("")
+	if code != http.StatusUnprocessableEntity || !strings.Contains(resp["error"], "org") {
+		t.Fatalf("expected render error of the active template, got %d %v", code, resp)
+	}
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	renderer, err := templater.NewDefaultRenderer(templater.Options{Sample: SampleTemplateData()})
+	if err != nil {
+		t.Fatalf("NewDefaultRenderer: %v", err)
+	}
+	out, err := renderer.Render(SampleTemplateData())
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal([]byte(out), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp["peer_id"] != "sample" || resp["listen_port"] != float64(51820) {
+		t.Fatalf("unexpected default response %v", resp)
+	}
+	if err := renderer.Reload(); err != nil {
+		t.Fatalf("expected reload of embedded template to be a no-op, got %v", err)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+		}},
+		PeerStore:         peers.NewStore(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+		Logger:            slog.New(slog.NewJSONHandler(&buf, nil)),
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+
+	rr := createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "alice"}), "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+
+	entries := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", line, err)
+		}
+		entries[entry["msg"].(string)] = entry
+	}
+
+	created, request := entries["peer created"], entries["request"]
+	if created == nil || request == nil {
+		t.Fatalf("expected peer created and request entries, got %v", entries)
+	}
+	if created["peer_id"] == "" || created["peer_id"] == nil {
+		t.Fatalf("expected peer_id in %v", created)
+	}
+	for _, entry := range []map[string]any{created, request} {
+		if entry["subject"] != "alice" || entry["client_ip"] != "192.0.2.10" {
+			t.Fatalf("expected subject and client_ip in %v", entry)
+		}
+		if entry["request_id"] != request["request_id"] || request["request_id"] == nil {
+			t.Fatalf("expected shared request_id in %v", entry)
+		}
+	}
+	if request["status"] != float64(http.StatusCreated) || request["path"] != "/peer" {
+		t.Fatalf("unexpected request entry %v", request)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	srv := newTestServer(t, peers.NewStore(), Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{}`),
+		Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+	})
+
+	const proxy = "127.0.0.1:40000"
+	cases := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "x-request-id", remote: proxy, headers: map[string]string{"X-Request-ID": "abc-123"}, want: "abc-123"},
+		{name: "cf-ray", remote: proxy, headers: map[string]string{"CF-Ray": "8f1e2d3c4b5a6978-AMS"}, want: "8f1e2d3c4b5a6978-AMS"},
+		{name: "preference", remote: proxy, headers: map[string]string{"X-Request-ID": "abc-123", "CF-Ray": "ray"}, want: "abc-123"},
+		{name: "invalid", remote: proxy, headers: map[string]string{"X-Request-ID": "bad id\n"}},
+		{name: "untrusted", remote: "192.0.2.10:12345", headers: map[string]string{"X-Request-ID": "abc-123"}},
+		{name: "missing", remote: proxy},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			req.RemoteAddr = tc.remote
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rr, req)
+
+			got := rr.Header().Get(RequestIDHeader)
+			if tc.want != "" && got != tc.want {
+				t.Fatalf("expected request id %q, got %q", tc.want, got)
+			}
+			if tc.want == "" && (got == "" || got == tc.headers["X-Request-ID"]) {
+				t.Fatalf("expected a generated request id, got %q", got)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	srv := newTestServer(t, peers.NewStore(), Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{"id":"{{ .PeerID }}"}`),
+		Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/peer", nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.MapClaims{"sub": "alice"}))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["POST /peer"]
+	if !ok {
+		t.Fatalf("expected request span, got %v", spans)
+	}
+	if root.SpanContext().TraceID().String() != traceID {
+		t.Fatalf("expected propagated trace id, got %s", root.SpanContext().TraceID())
+	}
+	for _, name := range []string{"wg.AddPeer", "store.Add", "template.Render"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected %s span, got %v", name, spans)
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("expected %s to be a child of the request span", name)
+		}
+	}
+}
+
+func TestAuditLimiter(t *testing.T) {
+	var limiter auditLimiter
+	start := time.Unix(0, 0)
+	for i := range authFailureAuditLimit {
+		if ok, _ := limiter.allow(start.Add(time.Duration(i) * time.Millisecond)); !ok {
+			t.Fatalf("expected event %d allowed", i)
+		}
+	}
+	for range 3 {
+		if ok, _ := limiter.allow(start.Add(time.Second)); ok {
+			t.Fatalf("expected events beyond the limit turned away")
+		}
+	}
+	ok, dropped := limiter.allow(start.Add(authFailureAuditWindow))
+	if !ok || dropped != 3 {
+		t.Fatalf("expected next window to allow and report 3 dropped, got %v %d", ok, dropped)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLog, err := audit.Open(audit.Options{Path: filepath.Join(t.TempDir(), "audit.jsonl"), HashChain: true})
+	if err != nil {
+		t.Fatalf("audit.Open: %v", err)
+	}
+	defer auditLog.Close()
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+		}},
+		PeerStore:         peers.NewStore(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+		Audit:             auditLog,
+		// The delete goes through a local proxy that supplies its ID.
+		TrustProxyLoopbackOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+	srv.newPeerID = func() string { return "peer-1" }
+
+	if rr := createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "alice"}), ""); rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	if rr := createPeer(t, srv, "192.0.2.11:12345", "not-a-token", ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/peer/peer-1", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set(RequestIDHeader, "delete-1")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete peer: status %d", rr.Code)
+	}
+
+	query := func(target string) []audit.Event {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("query %s: status %d: %s", target, rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			Events []audit.Event `json:"events"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return resp.Events
+	}
+
+	events := query("/admin/audit")
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	created, failed, deleted := events[0], events[1], events[2]
+	if created.Action != audit.ActionPeerCreated || created.Actor != "alice" || created.PeerID != "peer-1" || created.ClientIP != "192.0.2.10" {
+		t.Fatalf("unexpected create event %+v", created)
+	}
+	if failed.Action != audit.ActionAuthFailed || failed.ClientIP != "192.0.2.11" || !strings.HasPrefix(failed.Reason, "invalid token") {
+		t.Fatalf("unexpected auth failure event %+v", failed)
+	}
+	if deleted.Action != audit.ActionPeerDeleted || deleted.Actor != audit.ActorAdmin || deleted.RequestID != "delete-1" {
+		t.Fatalf("unexpected delete event %+v", deleted)
+	}
+
+	if events := query("/admin/audit?action=peer.deleted&limit=5"); len(events) != 1 || events[0].Action != audit.ActionPeerDeleted {
+		t.Fatalf("expected the delete event, got %+v", events)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/audit/verify", nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/audit?since=yesterday", nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid since, got %d", rr.Code)
+	}
+}
+
+func TestPeerEvents(t *testing.T) {
+	bus := events.NewBus()
+	var published []events.Event
+	bus.Handle(func(event events.Event) { published = append(published, event) })
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+		}},
+		PeerStore:         peers.NewStore(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+		Events:            bus,
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+	srv.newPeerID = func() string { return "peer-1" }
+
+	if rr := createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "alice"}), ""); rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/peer/peer-1", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete peer: status %d", rr.Code)
+	}
+
+	if len(published) != 2 {
+		t.Fatalf("expected two events, got %+v", published)
+	}
+	for i, typ := range []string{events.PeerCreated, events.PeerDeleted} {
+		event := published[i]
+		if event.Type != typ || event.PeerID != "peer-1" || event.Interface != "wg0" || event.Owner != "alice" || event.ID == "" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	bus := events.NewBus()
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+		}},
+		PeerStore:         peers.NewStore(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+		Events:            bus,
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+	httpSrv := httptest.NewServer(srv.Handler())
+	defer httpSrv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpSrv.URL+"/events?owner=alice", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	bus.Publish(events.Event{Type: events.PeerCreated, PeerID: "peer-1", Interface: "wg0", Owner: "bob"})
+	bus.Publish(events.Event{Type: events.PeerDeleted, PeerID: "peer-2", Interface: "wg0", Owner: "alice"})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var message []string
+	for len(message) < 3 {
+		select {
+		case line := <-lines:
+			message = append(message, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event, got %v", message)
+		}
+	}
+	if !strings.HasPrefix(message[0], "id: ") || message[1] != "event: "+events.PeerDeleted {
+		t.Fatalf("unexpected message %v", message)
+	}
+	var event events.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(message[2], "data: ")), &event); err != nil {
+		t.Fatalf("decode data: %v", err)
+	}
+	if event.PeerID != "peer-2" || event.Owner != "alice" {
+		t.Fatalf("expected only alice's event, got %+v", event)
+	}
+}
+
+func TestEventStreamEndsOnShutdown(t *testing.T) {
+	bus := events.NewBus()
+	srv, err := New(Options{
+		Interfaces: []Interface{{
+			Name:     "wg0",
+			Endpoint: "example.com:51820",
+			Renderer: newTestRenderer(t, `{}`),
+			Manager:  wg.NewManagerWithClient(wg.NewFakeDevice("wg0"), "wg0", 0),
+		}},
+		PeerStore:         peers.NewStore(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "pass",
+		JWTSecret:         testJWTSecret,
+		Events:            bus,
+	})
+	if err != nil {
+		t.Fatalf("New server: %v", err)
+	}
+	httpSrv := httptest.NewServer(srv.Handler())
+	defer httpSrv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpSrv.URL+"/events", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	ended := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, resp.Body)
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the stream to end on shutdown")
+	}
+}
+
+func TestWriteGap(t *testing.T) {
+	bus := events.NewBus()
+	sub := bus.Subscribe(1)
+	defer sub.Close()
+	for i := 0; i < 3; i++ {
+		bus.Publish(events.Event{Type: events.PeerCreated})
+	}
+
+	rr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rr)
+	if err := writeGap(c, sub); err != nil {
+		t.Fatalf("writeGap: %v", err)
+	}
+	want := "event: gap\ndata: {\"dropped\":2}\n\n"
+	if rr.Body.String() != want {
+		t.Fatalf("expected %q, got %q", want, rr.Body.String())
+	}
+	if err := writeGap(c, sub); err != nil || rr.Body.String() != want {
+		t.Fatalf("expected no second gap, got %q", rr.Body.String())
+	}
+}
+
+func TestPeerStatus(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	srv := newTestServer(t, store, Interface{
+		Name:     "wg0",
+		Endpoint: "example.com:51820",
+		Renderer: newTestRenderer(t, `{}`),
+		Manager:  mgr,
+	})
+	srv.newPeerID = func() string { return "peer-1" }
+	aliceToken := signToken(t, jwt.MapClaims{"sub": "alice"})
+	if rr := createPeer(t, srv, "192.0.2.10:12345", aliceToken, ""); rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+
+	get := func(target, auth string, out any) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if auth == "" {
+			req.SetBasicAuth("user", "pass")
+		} else {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), out); err != nil {
+				t.Fatalf("decode %s: %v", target, err)
+			}
+		}
+		return rr.Code
+	}
+
+	var status map[string]any
+	if code := get("/peer/peer-1", aliceToken, &status); code != http.StatusOK {
+		t.Fatalf("get peer: status %d", code)
+	}
+	if status["state"] != string(peers.StatePending) || status["first_connected_at"] != nil {
+		t.Fatalf("expected pending peer, got %v", status)
+	}
+	if _, ok := status["private_key"]; ok {
+		t.Fatalf("expected no key material, got %v", status)
+	}
+
+	stored, _ := store.Get("peer-1")
+	pub, err := wgtypes.ParseKey(stored.PublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	if err := device.Handshake(pub, time.Now(), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 40000}); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	gc.New(gc.Options{Interval: time.Minute, Store: store, Manager: mgr, Interface: "wg0"}).RunOnce(context.Background(), audit.ActorSystem)
+
+	if code := get("/peer/peer-1", "", &status); code != http.StatusOK {
+		t.Fatalf("get peer as admin: status %d", code)
+	}
+	if status["state"] != string(peers.StateConnected) || status["endpoint"] != "198.51.100.7:40000" || status["first_connected_at"] == nil {
+		t.Fatalf("expected connected peer, got %v", status)
+	}
+	bobToken := signToken(t, jwt.MapClaims{"sub": "bob"})
+	if code := get("/peer/peer-1", bobToken, &status); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another owner, got %d", code)
+	}
+
+	var list struct {
+		Peers []peerStatus `json:"peers"`
+	}
+	cases := []struct {
+		target, auth string
+		want         int
+	}{
+		{"/peers", "", 1},
+		{"/peers", aliceToken, 1},
+		{"/peers", bobToken, 0},
+		{"/peers?state=connected", "", 1},
+		{"/peers?state=pending", "", 0},
+		{"/peers?interface=wg1", "", 0},
+	}
+	for _, tc := range cases {
+		list.Peers = nil
+		if code := get(tc.target, tc.auth, &list); code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.target, code)
+		}
+		if len(list.Peers) != tc.want {
+			t.Fatalf("%s: expected %d peers, got %+v", tc.target, tc.want, list.Peers)
+		}
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	store := peers.NewStore()
+	device := wg.NewFakeDevice("wg0")
+	mgr := wg.NewManagerWithClient(device, "wg0", 0)
+	auditLog, err := audit.Open(audit.Options{Path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil {
+		t.Fatalf("audit.Open: %v", err)
+	}
+	defer auditLog.Close()
+	collector := gc.New(gc.Options{
+		Interval:          time.Minute,
+		Store:             store,
+		Manager:           mgr,
+		Interface:         "wg0",
+		NeverConnectedTTL: time.Nanosecond,
+		Audit:             auditLog,
+	})
+	srv := newTestServer(t, store, Interface{
+		Name:      "wg0",
+		Endpoint:  "example.com:51820",
+		Renderer:  newTestRenderer(t, `{}`),
+		Manager:   mgr,
+		Collector: collector,
+	})
+	srv.newPeerID = func() string { return "peer-1" }
+	if rr := createPeer(t, srv, "192.0.2.10:12345", signToken(t, jwt.MapClaims{"sub": "alice"}), ""); rr.Code != http.StatusCreated {
+		t.Fatalf("create peer: status %d", rr.Code)
+	}
+	time.Sleep(time.Millisecond)
+
+	runGC := func(body string) (int, []gcResult) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/gc", strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		var resp struct {
+			Results []gcResult `json:"results"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return rr.Code, resp.Results
+	}
+
+	if code, _ := runGC(`{"interface":"wg9"}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown interface, got %d", code)
+	}
+
+	code, results := runGC(`{"dry_run":true}`)
+	if code != http.StatusOK || len(results) != 1 || !results[0].DryRun || len(results[0].Removed) != 1 {
+		t.Fatalf("unexpected dry run result %d %+v", code, results)
+	}
+	if removal := results[0].Removed[0]; removal.PeerID != "peer-1" || removal.Reason != gc.ReasonNeverConnected {
+		t.Fatalf("unexpected removal %+v", removal)
+	}
+	if _, err := store.Get("peer-1"); err != nil {
+		t.Fatalf("expected peer kept by dry run: %v", err)
+	}
+
+	device.FailNext(wg.FakeOpConfigure, errors.New("netlink busy"))
+	code, results = runGC("")
+	if code != http.StatusInternalServerError || len(results) != 1 || results[0].Error == "" || len(results[0].Removed) != 0 {
+		t.Fatalf("expected the device failure reported, got %d %+v", code, results)
+	}
+	if _, err := store.Get("peer-1"); err != nil {
+		t.Fatalf("expected peer kept after failed run: %v", err)
+	}
+
+	code, results = runGC("")
+	if code != http.StatusOK || len(results) != 1 || results[0].DryRun || len(results[0].Removed) != 1 || results[0].Error != "" {
+		t.Fatalf("unexpected result %d %+v", code, results)
+	}
+	if _, err := store.Get("peer-1"); !errors.Is(err, peers.ErrNotFound) {
+		t.Fatalf("expected peer removed, got err %v", err)
+	}
+	recorded, err := auditLog.Query(audit.Filter{Action: audit.ActionPeerRemoved})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(recorded) != 1 || recorded[0].Actor != audit.ActorAdmin {
+		t.Fatalf("expected the removal audited as the admin, got %+v", recorded)
+	}
+}
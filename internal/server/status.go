@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/example/wireguard-gateway/internal/peers"
+)
+
+// peerStatus is the API view of a peer. It leaves out the key material.
+type peerStatus struct {
+	ID               string      `json:"id"`
+	Interface        string      `json:"interface"`
+	Owner            string      `json:"owner,omitempty"`
+	Note             string      `json:"note,omitempty"`
+	PublicKey        string      `json:"public_key"`
+	AllowedIPs       string      `json:"allowed_ips"`
+	CreatedAt        time.Time   `json:"created_at"`
+	State            peers.State `json:"state"`
+	StateChangedAt   time.Time   `json:"state_changed_at"`
+	FirstConnectedAt *time.Time  `json:"first_connected_at"`
+	LastHandshakeAt  *time.Time  `json:"last_handshake_at"`
+	Endpoint         string      `json:"endpoint,omitempty"`
+}
+
+func newPeerStatus(peer *peers.Peer) peerStatus {
+	return peerStatus{
+		ID:               peer.ID,
+		Interface:        peer.Interface,
+		Owner:            peer.Owner,
+		Note:             peer.Note,
+		PublicKey:        peer.PublicKey,
+		AllowedIPs:       peer.AllowedCIDR,
+		CreatedAt:        peer.CreatedAt,
+		State:            peer.State,
+		StateChangedAt:   peer.StateChangedAt,
+		FirstConnectedAt: peer.FirstConnectedAt,
+		LastHandshakeAt:  peer.LastHandshakeAt,
+		Endpoint:         peer.Endpoint,
+	}
+}
+
+func (s *Server) handleGetPeer(c *gin.Context) {
+	peer, err := tracedValue(c.Request.Context(), "store.Get", func() (*peers.Peer, error) {
+		return s.opts.PeerStore.Get(c.Param("id"))
+	})
+	if err != nil || !canAccessPeer(c, peer.Owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+		return
+	}
+	c.JSON(http.StatusOK, newPeerStatus(peer))
+}
+
+// handleListPeers lists the peers visible to the caller, oldest first: all
+// of them for admins, their own for JWT callers. The state and interface
+// query parameters filter the list.
+func (s *Server) handleListPeers(c *gin.Context) {
+	state, iface := peers.State(c.Query("state")), c.Query("interface")
+	list, _ := tracedValue(c.Request.Context(), "store.List", func() ([]*peers.Peer, error) {
+		return s.opts.PeerStore.List(), nil
+	})
+
+	result := make([]peerStatus, 0, len(list))
+	for _, peer := range list {
+		if !canAccessPeer(c, peer.Owner) || state != "" && peer.State != state || iface != "" && peer.Interface != iface {
+			continue
+		}
+		result = append(result, newPeerStatus(peer))
+	}
+	slices.SortFunc(result, func(a, b peerStatus) int {
+		if n := a.CreatedAt.Compare(b.CreatedAt); n != 0 {
+			return n
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	c.JSON(http.StatusOK, gin.H{"peers": result})
+}
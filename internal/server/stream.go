@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/example/wireguard-gateway/internal/events"
+)
+
+const (
+	// streamBuffer is the number of events a stream client may fall behind
+	// by before further events are dropped for it.
+	streamBuffer = 64
+
+	// streamKeepalive is how often an idle stream sends a comment so that
+	// proxies keep the connection open.
+	streamKeepalive = 15 * time.Second
+)
+
+// handleEventStream streams peer events as server-sent events, optionally
+// limited to one interface or owner. When events were dropped because the
+// client fell behind, a gap event with the count precedes the next one.
+func (s *Server) handleEventStream(c *gin.Context) {
+	if s.opts.Events == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "event stream not configured"})
+		return
+	}
+	iface, owner := c.Query("interface"), c.Query("owner")
+
+	sub := s.opts.Events.Subscribe(streamBuffer)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-keepalive.C:
+			if err := writeGap(c, sub); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-sub.C:
+			if err := writeGap(c, sub); err != nil {
+				return
+			}
+			if (iface == "" || event.Interface == iface) && (owner == "" || event.Owner == owner) {
+				if err := writeEvent(c, event); err != nil {
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes one event in the text/event-stream format.
+func writeEvent(c *gin.Context, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// writeGap writes a gap event when events were dropped for sub since the
+// last check, so that the client knows to refetch the peers it follows.
+func writeGap(c *gin.Context, sub *events.Subscription) error {
+	dropped := sub.Dropped()
+	if dropped == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(c.Writer, "event: gap\ndata: {\"dropped\":%d}\n\n", dropped)
+	return err
+}
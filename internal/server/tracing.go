@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/example/wireguard-gateway/internal/server")
+
+// requestTracer wraps every request in a server span, continuing a trace
+// propagated by the caller. Handlers start child spans from the request
+// context.
+func requestTracer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("request_id", c.GetString(requestIDContextKey)),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traced runs fn in a child span of ctx named after the operation and
+// records its error on the span.
+func traced(ctx context.Context, name string, fn func() error) error {
+	_, err := tracedValue(ctx, name, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
+
+// tracedValue is traced for operations that return a value.
+func tracedValue[T any](ctx context.Context, name string, fn func() (T, error)) (T, error) {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	value, err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return value, err
+}
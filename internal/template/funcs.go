@@ -0,0 +1,100 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// funcs returns the functions available to templates. env only reads the
+// variables listed in allowedEnv.
+func funcs(allowedEnv []string) template.FuncMap {
+	return template.FuncMap{
+		"json":       jsonValue,
+		"b64enc":     b64enc,
+		"b64dec":     b64dec,
+		"default":    defaultValue,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"formatTime": formatTime,
+		"now":        time.Now,
+		"join":       join,
+		"sha256":     sha256Hex,
+		"env": func(name string) (string, error) {
+			if !slices.Contains(allowedEnv, name) {
+				return "", fmt.Errorf("environment variable %s is not allowed", name)
+			}
+			return os.Getenv(name), nil
+		},
+	}
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func b64dec(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// defaultValue returns value unless it is missing or empty, in which case
+// it returns def. It is meant for pipelines: {{ .Note | default "none" }}.
+func defaultValue(def, value any) any {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	}
+	return value
+}
+
+// formatTime formats t with a Go reference-time layout. RFC3339 and the
+// other layout names of the time package are accepted as well.
+func formatTime(layout string, t time.Time) string {
+	switch layout {
+	case "RFC3339":
+		layout = time.RFC3339
+	case "RFC1123":
+		layout = time.RFC1123
+	case "DateOnly":
+		layout = time.DateOnly
+	case "DateTime":
+		layout = time.DateTime
+	}
+	return t.Format(layout)
+}
+
+// join formats the elements of list and joins them with sep.
+func join(sep string, list any) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: cannot join %T", list)
+	}
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of s.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,31 +2,135 @@ package template
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/example/wireguard-gateway/templates"
 )
 
+// reloads counts template reloads by outcome ("ok" or "failed") and is
+// published through expvar.
+var reloads = expvar.NewMap("template_reloads")
+
+// fallbacks counts renders answered by the fallback template.
+var fallbacks = expvar.NewInt("template_fallbacks")
+
+// ErrInvalidJSON is returned by a JSON renderer whose output does not parse
+// as JSON.
+var ErrInvalidJSON = errors.New("rendered template is not valid JSON")
+
+// ErrInvalidTemplate is returned when a template fails its dry run against
+// the sample data. The previously loaded template stays in use.
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// LoadError reports a template file that could not be loaded.
+type LoadError struct {
+	// Path is the template file, or the directory of a Set that could not
+	// be read.
+	Path string
+	Err  error
+}
+
+func (e *LoadError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// escapeFunc is the name under which the JSON escaper is registered.
+const escapeFunc = "_jsonEscape"
+
+// Options configures how templates are loaded.
+type Options struct {
+	// Sample is rendered with every newly loaded template. A template that
+	// fails, for example because it references a key the sample does not
+	// have, is rejected with ErrInvalidTemplate. Nil skips the dry run.
+	Sample any
+	// Env lists the environment variables the env function may read.
+	Env []string
+	// Fallback renders in place of a JSON template whose rendering fails.
+	Fallback *Renderer
+}
+
 // Renderer wraps a text template for rendering JSON responses.
 type Renderer struct {
 	mu      sync.RWMutex
 	tpl     *template.Template
 	tplPath string
+	json    bool
+	opts    Options
+	// loaded describes the template file as it was when last read.
+	loaded os.FileInfo
 }
 
 // NewRenderer loads a template from the given path.
 func NewRenderer(path string) (*Renderer, error) {
-	r := &Renderer{tplPath: path}
+	return load(&Renderer{tplPath: path})
+}
+
+// NewJSONRenderer loads a template that produces JSON. The output of every
+// action is escaped for use inside a JSON string unless it comes from the
+// json function, and rendered output that does not parse as JSON is
+// rejected with ErrInvalidJSON.
+func NewJSONRenderer(path string, opts Options) (*Renderer, error) {
+	return load(&Renderer{tplPath: path, json: true, opts: opts})
+}
+
+// NewDefaultRenderer returns a renderer for the embedded default template.
+func NewDefaultRenderer(opts Options) (*Renderer, error) {
+	return Compile(templates.PeerResponse, true, opts)
+}
+
+// Compile builds a renderer from template source rather than a file, in
+// JSON mode when jsonMode is set. Reloading it does nothing.
+func Compile(content string, jsonMode bool, opts Options) (*Renderer, error) {
+	r := &Renderer{json: jsonMode, opts: opts}
+	tpl, err := r.parse("inline", content)
+	if err != nil {
+		return nil, err
+	}
+	r.tpl = tpl
+	return r, nil
+}
+
+func load(r *Renderer) (*Renderer, error) {
 	if err := r.reload(); err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-// Render executes the template using the provided data.
+// ContentType returns the media type of the rendered output.
+func (r *Renderer) ContentType() string {
+	if r.json {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Render executes the template using the provided data. A JSON template
+// that fails to render answers with its fallback template, if it has one.
 func (r *Renderer) Render(data any) (string, error) {
+	out, err := r.RenderStrict(data)
+	if err != nil && r.json && r.opts.Fallback != nil {
+		fallbacks.Add(1)
+		slog.Warn("template render failed; using fallback template", "path", r.tplPath, "error", err)
+		return r.opts.Fallback.Render(data)
+	}
+	return out, err
+}
+
+// RenderStrict executes the template like Render, but returns the error
+// of a failed render instead of rendering the fallback template.
+func (r *Renderer) RenderStrict(data any) (string, error) {
 	r.mu.RLock()
 	tpl := r.tpl
 	r.mu.RUnlock()
@@ -34,30 +138,190 @@ func (r *Renderer) Render(data any) (string, error) {
 	if tpl == nil {
 		return "", fmt.Errorf("template not loaded")
 	}
+	return r.execute(tpl, data)
+}
 
+func (r *Renderer) execute(tpl *template.Template, data any) (string, error) {
 	var buf bytes.Buffer
 	if err := tpl.Execute(&buf, data); err != nil {
 		return "", err
 	}
+	if r.json && !json.Valid(buf.Bytes()) {
+		return "", ErrInvalidJSON
+	}
 	return buf.String(), nil
 }
 
-// Reload reloads the template from disk.
+// Reload reloads the template from disk. The previous template keeps
+// serving when the new one cannot be loaded.
 func (r *Renderer) Reload() error {
-	return r.reload()
+	if r.tplPath == "" {
+		return nil
+	}
+	if err := r.reload(); err != nil {
+		reloads.Add("failed", 1)
+		slog.Error("template reload failed", "path", r.tplPath, "error", err)
+		return err
+	}
+	reloads.Add("ok", 1)
+	slog.Info("template reloaded", "path", r.tplPath)
+	return nil
+}
+
+// Watch polls the template file every interval and reloads it after a
+// change, until ctx is cancelled. A change is picked up once the file has
+// stayed the same for a full interval, so a template that is still being
+// written is not loaded half-way. onReload, if not nil, receives the
+// outcome of every reload.
+func (r *Renderer) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	if r.tplPath == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pending os.FileInfo
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.tplPath)
+		if err != nil {
+			// The file may be in the middle of being replaced.
+			continue
+		}
+		r.mu.RLock()
+		loaded := r.loaded
+		r.mu.RUnlock()
+		switch {
+		case sameFile(info, loaded):
+			pending = nil
+		case pending == nil || !sameFile(info, pending):
+			pending = info
+		default:
+			err := r.Reload()
+			if err != nil {
+				// Do not retry until the file changes again.
+				r.mu.Lock()
+				r.loaded = info
+				r.mu.Unlock()
+			}
+			if onReload != nil {
+				onReload(err)
+			}
+			pending = nil
+		}
+	}
+}
+
+// sameFile reports whether two observations of the template file match.
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
 }
 
 func (r *Renderer) reload() error {
+	info, err := os.Stat(r.tplPath)
+	if err != nil {
+		return &LoadError{Path: r.tplPath, Err: fmt.Errorf("read template: %w", err)}
+	}
 	content, err := os.ReadFile(r.tplPath)
 	if err != nil {
-		return fmt.Errorf("read template: %w", err)
+		return &LoadError{Path: r.tplPath, Err: fmt.Errorf("read template: %w", err)}
 	}
-	tpl, err := template.New(filepath.Base(r.tplPath)).Parse(string(content))
+	tpl, err := r.parse(filepath.Base(r.tplPath), string(content))
 	if err != nil {
-		return fmt.Errorf("parse template: %w", err)
+		return &LoadError{Path: r.tplPath, Err: err}
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.tpl = tpl
+	r.loaded = info
 	return nil
 }
+
+// parse prepares template source for the renderer's mode and dry-runs it.
+// Looking up a missing map key, such as an absent claim, is an error in
+// both modes, so that the dry run catches misspelled keys; templates use
+// index for keys that may be missing.
+func (r *Renderer) parse(name, content string) (*template.Template, error) {
+	tpl := template.New(name).Option("missingkey=error").Funcs(funcs(r.opts.Env))
+	if r.json {
+		tpl = tpl.Funcs(template.FuncMap{escapeFunc: jsonEscape})
+	}
+	tpl, err := tpl.Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	if r.json {
+		for _, t := range tpl.Templates() {
+			if t.Tree != nil {
+				escapeList(t.Tree.Root)
+			}
+		}
+	}
+	if r.opts.Sample != nil {
+		if _, err := r.execute(tpl, r.opts.Sample); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+		}
+	}
+	return tpl, nil
+}
+
+// rawJSON is JSON produced by the json function. It is written verbatim.
+type rawJSON string
+
+// jsonValue encodes v as JSON.
+func jsonValue(v any) (rawJSON, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return rawJSON(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// jsonEscape formats v and escapes it for use inside a JSON string.
+func jsonEscape(v any) (string, error) {
+	if raw, ok := v.(rawJSON); ok {
+		return string(raw), nil
+	}
+	quoted, err := jsonValue(fmt.Sprint(v))
+	if err != nil {
+		return "", err
+	}
+	return string(quoted[1 : len(quoted)-1]), nil
+}
+
+// escapeList pipes the output of every action below node through the JSON
+// escaper.
+func escapeList(node *parse.ListNode) {
+	if node == nil {
+		return
+	}
+	for _, n := range node.Nodes {
+		switch n := n.(type) {
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) > 0 {
+				continue
+			}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pipe.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(escapeFunc).SetPos(n.Pipe.Pos)},
+			})
+		case *parse.IfNode:
+			escapeList(n.List)
+			escapeList(n.ElseList)
+		case *parse.RangeNode:
+			escapeList(n.List)
+			escapeList(n.ElseList)
+		case *parse.WithNode:
+			escapeList(n.List)
+			escapeList(n.ElseList)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package template
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRendererRender(t *testing.T) {
@@ -29,3 +34,226 @@ func TestRendererRender(t *testing.T) {
 		t.Fatalf("expected %s, got %s", expected, out)
 	}
 }
+
+func TestJSONRendererEscapes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	content := `{"note":"{{ .Note }}","port":{{ .Port }},"tags":{{ json .Tags }}{{ if .Note }},"items":[{{ range $i, $v := .Tags }}{{ if $i }},{{ end }}"{{ $v }}"{{ end }}]{{ end }}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	renderer, err := NewJSONRenderer(path, Options{})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	out, err := renderer.Render(map[string]any{
+		"Note": `say "hi" \ <bye>`,
+		"Port": 51820,
+		"Tags": []string{`a"b`, "c"},
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	expected := `{"note":"say \"hi\" \\ <bye>","port":51820,"tags":["a\"b","c"],"items":["a\"b","c"]}`
+	if out != expected {
+		t.Fatalf("expected %s, got %s", expected, out)
+	}
+}
+
+func TestJSONRendererRejectsInvalidJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	if err := os.WriteFile(path, []byte(`{"value":{{ .Value }}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	renderer, err := NewJSONRenderer(path, Options{})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	if _, err := renderer.Render(map[string]string{"Value": "hello"}); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("expected ErrInvalidJSON, got %v", err)
+	}
+}
+
+func TestJSONRendererReloadValidates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	if err := os.WriteFile(path, []byte(`{"id":"{{ .PeerID }}"}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	renderer, err := NewJSONRenderer(path, Options{Sample: map[string]any{"PeerID": "sample"}})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	for _, content := range []string{
+		`{"id":"{{ .PeerIdd }}"}`,
+		`{"id":{{ .PeerID }}}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write template: %v", err)
+		}
+		if err := renderer.Reload(); !errors.Is(err, ErrInvalidTemplate) {
+			t.Fatalf("expected ErrInvalidTemplate for %s, got %v", content, err)
+		}
+	}
+
+	out, err := renderer.Render(map[string]any{"PeerID": "p1"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if expected := `{"id":"p1"}`; out != expected {
+		t.Fatalf("expected previous template %s, got %s", expected, out)
+	}
+}
+
+func TestRendererWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	if err := os.WriteFile(path, []byte(`{"v":1}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	renderer, err := NewJSONRenderer(path, Options{Sample: map[string]any{}})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outcomes := make(chan error, 10)
+	go renderer.Watch(ctx, 10*time.Millisecond, func(err error) { outcomes <- err })
+
+	counter := func(key string) int64 {
+		if v, ok := reloads.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	failed := counter("failed")
+	if err := os.WriteFile(path, []byte(`{"v":`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if !waitFor(func() bool { return counter("failed") > failed }) {
+		t.Fatalf("expected failed reload to be counted")
+	}
+	if out, err := renderer.Render(map[string]any{}); err != nil || out != `{"v":1}` {
+		t.Fatalf("expected previous template, got %q, %v", out, err)
+	}
+	if err := <-outcomes; err == nil {
+		t.Fatalf("expected failed reload to be reported")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"v":22}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if !waitFor(func() bool {
+		out, err := renderer.Render(map[string]any{})
+		return err == nil && out == `{"v":22}`
+	}) {
+		t.Fatalf("expected changed template to be loaded")
+	}
+	if err := <-outcomes; err != nil {
+		t.Fatalf("expected reload to be reported, got %v", err)
+	}
+}
+
+func TestRendererFuncs(t *testing.T) {
+	t.Setenv("GATEWAY_REGION", "eu-1")
+	t.Setenv("GATEWAY_SECRET", "hunter2")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	content := `{"b64":"{{ b64enc .Name }}","plain":"{{ b64dec "aGk=" }}","note":"{{ .Note | default "none" }}",` +
+		`"upper":"{{ upper .Name }}","lower":"{{ lower "AB" }}","day":"{{ formatTime "DateOnly" .At }}",` +
+		`"dns":"{{ join ", " .DNS }}","sum":"{{ sha256 .Name }}","region":"{{ env "GATEWAY_REGION" }}"}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	renderer, err := NewJSONRenderer(path, Options{Env: []string{"GATEWAY_REGION"}})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	out, err := renderer.Render(map[string]any{
+		"Name": "ab",
+		"Note": "",
+		"At":   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		"DNS":  []string{"1.1.1.1", "8.8.8.8"},
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	expected := `{"b64":"YWI=","plain":"hi","note":"none","upper":"AB","lower":"ab","day":"2024-05-06",` +
+		`"dns":"1.1.1.1, 8.8.8.8","sum":"fb8e20fc2e4c3f248c60c39bd652f3c1347298bb977b8b4d5903b85055620603","region":"eu-1"}`
+	if out != expected {
+		t.Fatalf("expected %s, got %s", expected, out)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"secret":"{{ env "GATEWAY_SECRET" }}"}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if err := renderer.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := renderer.Render(map[string]any{}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected env lookup to be refused, got %v", err)
+	}
+}
+
+func TestRendererFallback(t *testing.T) {
+	fallback, err := Compile(`{"fallback":"{{ .Value }}"}`, true, Options{})
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tpl.json.tmpl")
+	if err := os.WriteFile(path, []byte(`{"custom":{{ .Value }}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	renderer, err := NewJSONRenderer(path, Options{Fallback: fallback})
+	if err != nil {
+		t.Fatalf("NewJSONRenderer: %v", err)
+	}
+
+	before := fallbacks.Value()
+	out, err := renderer.Render(map[string]any{"Value": "x"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if expected := `{"fallback":"x"}`; out != expected {
+		t.Fatalf("expected %s, got %s", expected, out)
+	}
+	if fallbacks.Value() != before+1 {
+		t.Fatalf("expected fallback to be counted")
+	}
+
+	if out, err := renderer.Render(map[string]any{"Value": 1}); err != nil || out != `{"custom":1}` {
+		t.Fatalf("expected custom template when it renders, got %q, %v", out, err)
+	}
+
+	before = fallbacks.Value()
+	if _, err := renderer.RenderStrict(map[string]any{"Value": "x"}); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("expected RenderStrict to return the error, got %v", err)
+	}
+	if fallbacks.Value() != before {
+		t.Fatalf("expected RenderStrict not to use the fallback")
+	}
+}
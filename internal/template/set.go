@@ -0,0 +1,184 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateExt is the suffix of template files in a Set directory.
+const templateExt = ".tmpl"
+
+// Set holds the named templates found in a directory. A file's name up to
+// its first dot names the template, so android.json.tmpl is "android".
+// Files ending in .json.tmpl are rendered in JSON mode, others as text.
+type Set struct {
+	dir  string
+	opts Options
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+
+	mu        sync.RWMutex
+	renderers map[string]*Renderer
+	// loaded describes the directory as it was when last scanned.
+	loaded string
+}
+
+// NewSet loads every template in dir with the given options.
+func NewSet(dir string, opts Options) (*Set, error) {
+	s := &Set{dir: dir, opts: opts, renderers: make(map[string]*Renderer)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the named template.
+func (s *Set) Get(name string) (*Renderer, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.renderers[name]
+	return r, ok
+}
+
+// Names lists the loaded templates in sorted order.
+func (s *Set) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.renderers))
+	for name := range s.renderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reload rescans the directory: new files are loaded, removed files are
+// dropped and existing templates are reloaded. A template that fails to
+// load keeps its previous version, or stays unavailable if it is new.
+func (s *Set) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	files, signature, err := s.scan()
+	if err != nil {
+		reloads.Add("failed", 1)
+		slog.Error("template directory scan failed", "dir", s.dir, "error", err)
+		return &LoadError{Path: s.dir, Err: err}
+	}
+
+	renderers := make(map[string]*Renderer, len(files))
+	var errs []error
+	for name, path := range files {
+		if r, ok := s.renderers[name]; ok && r.tplPath == path {
+			if err := r.Reload(); err != nil {
+				errs = append(errs, err)
+			}
+			renderers[name] = r
+			continue
+		}
+
+		r, err := load(&Renderer{tplPath: path, json: isJSON(path), opts: s.opts})
+		if err != nil {
+			reloads.Add("failed", 1)
+			slog.Error("template load failed", "path", path, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		reloads.Add("ok", 1)
+		slog.Info("template loaded", "path", path, "template", name)
+		renderers[name] = r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renderers = renderers
+	s.loaded = signature
+	return errors.Join(errs...)
+}
+
+// Watch polls the directory every interval and reloads the set after a
+// change, until ctx is cancelled. Like Renderer.Watch it waits for the
+// directory to stay the same for a full interval first, and passes the
+// outcome of every reload to onReload if it is not nil.
+func (s *Set) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, signature, err := s.scan()
+		if err != nil {
+			continue
+		}
+		s.mu.RLock()
+		loaded := s.loaded
+		s.mu.RUnlock()
+		switch {
+		case signature == loaded:
+			pending = ""
+		case signature != pending:
+			pending = signature
+		default:
+			// Failed templates are not retried until the directory
+			// changes again.
+			err := s.Reload()
+			if onReload != nil {
+				onReload(err)
+			}
+			pending = ""
+		}
+	}
+}
+
+// scan lists the template files in the directory by name, together with a
+// signature that changes whenever a file is added, removed or modified.
+func (s *Set) scan() (map[string]string, string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("read template dir: %w", err)
+	}
+
+	files := make(map[string]string)
+	var signature strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), templateExt) {
+			continue
+		}
+		name, _, _ := strings.Cut(entry.Name(), ".")
+		if name == "" {
+			continue
+		}
+		if _, ok := files[name]; ok {
+			return nil, "", fmt.Errorf("template dir: more than one file for template %q", name)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, "", fmt.Errorf("read template dir: %w", err)
+		}
+		files[name] = filepath.Join(s.dir, entry.Name())
+		fmt.Fprintf(&signature, "%s %d %d\n", entry.Name(), info.ModTime().UnixNano(), info.Size())
+	}
+	return files, signature.String(), nil
+}
+
+// isJSON reports whether a template file produces JSON.
+func isJSON(path string) bool {
+	return strings.HasSuffix(path, ".json"+templateExt)
+}
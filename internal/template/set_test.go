@@ -0,0 +1,66 @@
+package template
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSetReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write template: %v", err)
+		}
+	}
+	write("android.json.tmpl", `{"id":"{{ .PeerID }}"}`)
+	write("windows.conf.tmpl", `id = {{ .PeerID }}`)
+	write("README.md", `not a template`)
+
+	sample := map[string]any{"PeerID": "sample"}
+	set, err := NewSet(dir, Options{Sample: sample})
+	if err != nil {
+		t.Fatalf("NewSet: %v", err)
+	}
+	if names := set.Names(); !reflect.DeepEqual(names, []string{"android", "windows"}) {
+		t.Fatalf("unexpected templates %v", names)
+	}
+
+	windows, ok := set.Get("windows")
+	if !ok {
+		t.Fatalf("expected windows template")
+	}
+	if ct := windows.ContentType(); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("expected text content type, got %s", ct)
+	}
+	out, err := windows.Render(map[string]any{"PeerID": `a"b`})
+	if err != nil || out != `id = a"b` {
+		t.Fatalf("expected unescaped text output, got %q, %v", out, err)
+	}
+	android, _ := set.Get("android")
+	if ct := android.ContentType(); ct != "application/json" {
+		t.Fatalf("expected JSON content type, got %s", ct)
+	}
+
+	write("agent.json.tmpl", `{"id":"{{ .Missing }}"}`)
+	if err := os.Remove(filepath.Join(dir, "windows.conf.tmpl")); err != nil {
+		t.Fatalf("remove template: %v", err)
+	}
+	if err := set.Reload(); !errors.Is(err, ErrInvalidTemplate) {
+		t.Fatalf("expected ErrInvalidTemplate, got %v", err)
+	}
+	if names := set.Names(); !reflect.DeepEqual(names, []string{"android"}) {
+		t.Fatalf("unexpected templates %v", names)
+	}
+
+	write("agent.json.tmpl", `{"peer":"{{ .PeerID }}"}`)
+	if err := set.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := set.Get("agent"); !ok {
+		t.Fatalf("expected agent template after fix")
+	}
+}
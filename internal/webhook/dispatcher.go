@@ -0,0 +1,462 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/example/wireguard-gateway/internal/events"
+)
+
+// Request headers sent with every delivery.
+const (
+	HeaderEventID   = "X-Webhook-ID"
+	HeaderEventType = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultMinBackoff  = time.Second
+	defaultMaxBackoff  = 10 * time.Minute
+	defaultTimeout     = 10 * time.Second
+
+	// failedSuffix marks outbox files of deliveries that were given up on.
+	failedSuffix = ".failed"
+)
+
+// deliveries counts delivery attempts by outcome: "ok", "retried" (the
+// attempt failed and will be repeated) and "failed" (given up).
+var deliveries = expvar.NewMap("webhook_deliveries")
+
+// Target is an endpoint that receives events.
+type Target struct {
+	URL string
+	// Secret signs the requests. Deliveries are unsigned when it is empty.
+	Secret string
+	// Events limits the target to these event types; empty means all.
+	Events []string
+}
+
+// Options configures a Dispatcher.
+type Options struct {
+	Targets []Target
+	// OutboxDir keeps pending deliveries across restarts. When empty they
+	// are kept in memory only.
+	OutboxDir string
+	// MaxAttempts gives up on a delivery after this many failures;
+	// defaults to 10.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay between attempts, which
+	// doubles after every failure; they default to 1s and 10m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Client sends the requests; a client with a 10s timeout when nil.
+	Client *http.Client
+	Logger *slog.Logger
+}
+
+// delivery is one event on its way to one target.
+type delivery struct {
+	ID          string       `json:"id"`
+	URL         string       `json:"url"`
+	Event       events.Event `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+}
+
+// Dispatcher delivers events to webhook targets, retrying failures with
+// exponential backoff. Every target has a worker of its own, so a slow or
+// unreachable target does not hold up the others.
+type Dispatcher struct {
+	opts    Options
+	targets map[string]Target
+	// wake signals the worker of a target, by URL, that a delivery was
+	// queued.
+	wake    map[string]chan struct{}
+	nowFunc func() time.Time
+
+	// incoming holds the published events until Run turns them into
+	// deliveries; received signals that it is not empty.
+	incomingMu sync.Mutex
+	incoming   []events.Event
+	received   chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*delivery
+}
+
+// New constructs a dispatcher and loads the deliveries left in the outbox.
+func New(opts Options) (*Dispatcher, error) {
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	opts.Logger = opts.Logger.With("component", "webhook")
+
+	d := &Dispatcher{
+		opts:     opts,
+		targets:  make(map[string]Target, len(opts.Targets)),
+		wake:     make(map[string]chan struct{}, len(opts.Targets)),
+		nowFunc:  time.Now,
+		received: make(chan struct{}, 1),
+		pending:  make(map[string]*delivery),
+	}
+	for _, target := range opts.Targets {
+		if target.URL == "" {
+			return nil, errors.New("webhook target url is required")
+		}
+		// Deliveries name their target by URL.
+		if _, ok := d.targets[target.URL]; ok {
+			return nil, fmt.Errorf("duplicate webhook target url %s", target.URL)
+		}
+		d.targets[target.URL] = target
+		d.wake[target.URL] = make(chan struct{}, 1)
+	}
+	if opts.OutboxDir != "" {
+		if err := os.MkdirAll(opts.OutboxDir, 0o700); err != nil {
+			return nil, fmt.Errorf("create outbox: %w", err)
+		}
+		if err := d.loadOutbox(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Publish hands an event to the dispatcher without blocking; Run queues it
+// for every target that accepts its type. It is meant to be registered as
+// an events.Bus handler.
+func (d *Dispatcher) Publish(event events.Event) {
+	d.incomingMu.Lock()
+	d.incoming = append(d.incoming, event)
+	d.incomingMu.Unlock()
+	select {
+	case d.received <- struct{}{}:
+	default:
+	}
+}
+
+// runIncoming queues the published events until the context is cancelled,
+// and then persists those still waiting.
+func (d *Dispatcher) runIncoming(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			d.queueIncoming()
+			return
+		case <-d.received:
+			d.queueIncoming()
+		}
+	}
+}
+
+// queueIncoming creates and persists a delivery of every published event
+// for every target that accepts its type, and wakes those targets.
+func (d *Dispatcher) queueIncoming() {
+	d.incomingMu.Lock()
+	incoming := d.incoming
+	d.incoming = nil
+	d.incomingMu.Unlock()
+
+	queued := make(map[string]bool)
+	for _, event := range incoming {
+		for _, target := range d.opts.Targets {
+			if len(target.Events) > 0 && !slices.Contains(target.Events, event.Type) {
+				continue
+			}
+			dl := &delivery{
+				ID:          uuid.NewString(),
+				URL:         target.URL,
+				Event:       event,
+				NextAttempt: d.nowFunc(),
+			}
+			if err := d.save(dl); err != nil {
+				// The delivery still runs; it only would not survive a restart.
+				d.opts.Logger.Error("persist delivery", "event_id", event.ID, "url", target.URL, "error", err)
+			}
+			d.mu.Lock()
+			d.pending[dl.ID] = dl
+			d.mu.Unlock()
+			queued[target.URL] = true
+		}
+	}
+
+	for url := range queued {
+		select {
+		case d.wake[url] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pending returns the number of deliveries not yet completed.
+func (d *Dispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// Run delivers published events until the context is cancelled.
+// Deliveries still pending stay in the outbox.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		d.runIncoming(ctx)
+	}()
+	for url := range d.targets {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			d.runTarget(ctx, url)
+		}()
+	}
+	workers.Wait()
+}
+
+// runTarget delivers the events queued for one target, in order, until the
+// context is cancelled.
+func (d *Dispatcher) runTarget(ctx context.Context, url string) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake[url]:
+		case <-timer.C:
+		}
+
+		d.deliverDue(ctx, url)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next, ok := d.nextAttempt(url); ok {
+			timer.Reset(max(next.Sub(d.nowFunc()), 0))
+		}
+	}
+}
+
+// deliverDue attempts every delivery to a target whose next attempt is due.
+func (d *Dispatcher) deliverDue(ctx context.Context, url string) {
+	now := d.nowFunc()
+	d.mu.Lock()
+	var due []*delivery
+	for _, dl := range d.pending {
+		if dl.URL == url && !dl.NextAttempt.After(now) {
+			due = append(due, dl)
+		}
+	}
+	d.mu.Unlock()
+	slices.SortFunc(due, func(a, b *delivery) int { return a.Event.Time.Compare(b.Event.Time) })
+
+	for _, dl := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		d.attempt(ctx, dl)
+	}
+}
+
+// attempt sends a delivery once and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, dl *delivery) {
+	logger := d.opts.Logger.With("event_id", dl.Event.ID, "event", dl.Event.Type, "url", dl.URL)
+	err := d.send(ctx, d.targets[dl.URL], dl.Event)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		deliveries.Add("ok", 1)
+		delete(d.pending, dl.ID)
+		d.remove(dl, "")
+		return
+	}
+
+	dl.Attempts++
+	if dl.Attempts >= d.opts.MaxAttempts {
+		deliveries.Add("failed", 1)
+		logger.Error("webhook delivery failed, giving up", "attempts", dl.Attempts, "error", err)
+		delete(d.pending, dl.ID)
+		d.remove(dl, failedSuffix)
+		return
+	}
+	deliveries.Add("retried", 1)
+	dl.NextAttempt = d.nowFunc().Add(d.backoff(dl.Attempts))
+	logger.Warn("webhook delivery failed", "attempts", dl.Attempts, "retry_at", dl.NextAttempt, "error", err)
+	if err := d.save(dl); err != nil {
+		logger.Error("persist delivery", "error", err)
+	}
+}
+
+// send posts the event to the target. Any response other than 2xx is a
+// failure.
+func (d *Dispatcher) send(ctx context.Context, target Target, event events.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(d.nowFunc().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, event.ID)
+	req.Header.Set(HeaderEventType, event.Type)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if target.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(target.Secret, timestamp, body))
+	}
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for a request body: the
+// hex-encoded HMAC-SHA256 of the timestamp, a dot and the body, keyed with
+// the target's secret.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.opts.MinBackoff
+	for i := 1; i < attempts && delay < d.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.opts.MaxBackoff)
+}
+
+// nextAttempt returns the earliest scheduled attempt to a target, if any.
+func (d *Dispatcher) nextAttempt(url string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var next time.Time
+	for _, dl := range d.pending {
+		if dl.URL != url {
+			continue
+		}
+		if next.IsZero() || dl.NextAttempt.Before(next) {
+			next = dl.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// loadOutbox queues the deliveries persisted by a previous run. Deliveries
+// for targets that are no longer configured are set aside as failed.
+func (d *Dispatcher) loadOutbox() error {
+	paths, err := filepath.Glob(filepath.Join(d.opts.OutboxDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var dl delivery
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return fmt.Errorf("read outbox %s: %w", path, err)
+		}
+		if _, ok := d.targets[dl.URL]; !ok {
+			d.opts.Logger.Warn("dropping delivery for unknown target", "event_id", dl.Event.ID, "url", dl.URL)
+			d.remove(&dl, failedSuffix)
+			continue
+		}
+		d.pending[dl.ID] = &dl
+	}
+	if len(d.pending) > 0 {
+		d.opts.Logger.Info("loaded pending deliveries", "count", len(d.pending))
+	}
+	return nil
+}
+
+// save writes a delivery to the outbox, replacing its previous state.
+func (d *Dispatcher) save(dl *delivery) error {
+	if d.opts.OutboxDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	path := d.outboxPath(dl)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// remove deletes a delivery from the outbox or, with a suffix, renames it
+// to keep it for inspection.
+func (d *Dispatcher) remove(dl *delivery, suffix string) {
+	if d.opts.OutboxDir == "" {
+		return
+	}
+	path := d.outboxPath(dl)
+	var err error
+	if suffix == "" {
+		err = os.Remove(path)
+	} else {
+		err = os.Rename(path, strings.TrimSuffix(path, ".json")+suffix)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		d.opts.Logger.Error("update outbox", "event_id", dl.Event.ID, "error", err)
+	}
+}
+
+func (d *Dispatcher) outboxPath(dl *delivery) string {
+	return filepath.Join(d.opts.OutboxDir, dl.ID+".json")
+}
@@ -0,0 +1,243 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/wireguard-gateway/internal/events"
+)
+
+// receiver is a webhook endpoint that fails the first failures requests.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	got      chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	t.Helper()
+	r := &receiver{failures: failures, got: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		fail := len(r.requests) <= r.failures
+		r.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		r.got <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *receiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for request %d", i+1)
+		}
+	}
+}
+
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitPending(t *testing.T, d *Dispatcher, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending deliveries, got %d", n, d.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	recv, srv := newReceiver(t, 0)
+	d, err := New(Options{
+		Targets: []Target{
+			{URL: srv.URL, Secret: "s3cret"},
+			{URL: srv.URL + "/deleted-only", Events: []string{events.PeerDeleted}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	runDispatcher(t, d)
+
+	event := events.Event{ID: "ev-1", Type: events.PeerCreated, Time: time.Unix(0, 0).UTC(), PeerID: "p1", Interface: "wg0"}
+	d.Publish(event)
+	recv.wait(t, 1)
+	waitPending(t, d, 0)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if len(recv.requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(recv.requests))
+	}
+	req, body := recv.requests[0], recv.bodies[0]
+	var got events.Event
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if got != event {
+		t.Fatalf("expected %+v, got %+v", event, got)
+	}
+	if req.Header.Get(HeaderEventID) != "ev-1" || req.Header.Get(HeaderEventType) != events.PeerCreated {
+		t.Fatalf("unexpected headers %v", req.Header)
+	}
+	if want := Sign("s3cret", req.Header.Get(HeaderTimestamp), body); req.Header.Get(HeaderSignature) != want {
+		t.Fatalf("expected signature %s, got %s", want, req.Header.Get(HeaderSignature))
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	recv, srv := newReceiver(t, 2)
+	d, err := New(Options{
+		Targets:    []Target{{URL: srv.URL}},
+		OutboxDir:  t.TempDir(),
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	runDispatcher(t, d)
+
+	d.Publish(events.Event{ID: "ev-1", Type: events.PeerDeleted})
+	recv.wait(t, 3)
+	waitPending(t, d, 0)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	for _, req := range recv.requests {
+		if req.Header.Get(HeaderEventID) != "ev-1" {
+			t.Fatalf("expected the same event on every attempt")
+		}
+	}
+	if entries, _ := os.ReadDir(d.opts.OutboxDir); len(entries) != 0 {
+		t.Fatalf("expected empty outbox, got %v", entries)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	recv, srv := newReceiver(t, 100)
+	dir := t.TempDir()
+	d, err := New(Options{
+		Targets:     []Target{{URL: srv.URL}},
+		OutboxDir:   dir,
+		MaxAttempts: 2,
+		MinBackoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	runDispatcher(t, d)
+
+	d.Publish(events.Event{ID: "ev-1", Type: events.PeerRemoved})
+	recv.wait(t, 2)
+	waitPending(t, d, 0)
+
+	failed, _ := filepath.Glob(filepath.Join(dir, "*"+failedSuffix))
+	if len(failed) != 1 {
+		t.Fatalf("expected a failed delivery in the outbox, got %v", failed)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	recv, srv := newReceiver(t, 0)
+	dir := t.TempDir()
+	opts := Options{Targets: []Target{{URL: srv.URL}}, OutboxDir: dir}
+
+	first, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	first.Publish(events.Event{ID: "ev-1", Type: events.PeerCreated})
+	// Publishing leaves the disk to Run, since bus handlers must not block.
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected nothing persisted by Publish, got %v", entries)
+	}
+	// The first dispatcher stops before delivering, as if the process
+	// stopped, and persists the published event.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	first.Run(ctx)
+
+	second, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if second.Pending() != 1 {
+		t.Fatalf("expected the pending delivery loaded, got %d", second.Pending())
+	}
+	runDispatcher(t, second)
+	recv.wait(t, 1)
+	waitPending(t, second, 0)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if recv.requests[0].Header.Get(HeaderEventID) != "ev-1" {
+		t.Fatalf("expected the persisted event delivered")
+	}
+}
+
+func TestSlowTargetDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	recv, fast := newReceiver(t, 0)
+
+	d, err := New(Options{Targets: []Target{{URL: slow.URL}, {URL: fast.URL}}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	runDispatcher(t, d)
+
+	for _, id := range []string{"ev-1", "ev-2"} {
+		d.Publish(events.Event{ID: id, Type: events.PeerCreated, Time: time.Unix(0, 0).UTC()})
+	}
+	// Both events reach the fast target while the slow one still hangs on
+	// the first.
+	recv.wait(t, 2)
+}
+
+func TestDuplicateTargetURL(t *testing.T) {
+	_, err := New(Options{Targets: []Target{
+		{URL: "http://example.com/hook", Secret: "a"},
+		{URL: "http://example.com/hook", Secret: "b"},
+	}})
+	if err == nil {
+		t.Fatalf("expected duplicate target url to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package wg
+
+import (
+	"errors"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maxBatchPeers bounds the number of peer entries in one coalesced update.
+const maxBatchPeers = 512
+
+// errManagerClosed is returned for updates submitted after Close.
+var errManagerClosed = errors.New("manager closed")
+
+// batchRequest is one caller's set of peer changes, applied all or nothing.
+type batchRequest struct {
+	peers  []wgtypes.PeerConfig
+	result chan error
+}
+
+// batcher coalesces peer changes arriving within a window into a single
+// device configuration.
+type batcher struct {
+	window   time.Duration
+	apply    func(wgtypes.Config) error
+	requests chan batchRequest
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newBatcher(window time.Duration, apply func(wgtypes.Config) error) *batcher {
+	b := &batcher{
+		window:   window,
+		apply:    apply,
+		requests: make(chan batchRequest),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// submit queues peers and waits for the outcome of their update.
+func (b *batcher) submit(peers []wgtypes.PeerConfig) error {
+	req := batchRequest{peers: peers, result: make(chan error, 1)}
+	select {
+	case b.requests <- req:
+	case <-b.done:
+		return errManagerClosed
+	}
+	return <-req.result
+}
+
+// close flushes pending requests and stops the batcher.
+func (b *batcher) close() {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	for {
+		var first batchRequest
+		select {
+		case first = <-b.requests:
+		case <-b.stop:
+			return
+		}
+
+		pending := []batchRequest{first}
+		size := len(first.peers)
+		timer := time.NewTimer(b.window)
+	collect:
+		for size < maxBatchPeers {
+			select {
+			case req := <-b.requests:
+				pending = append(pending, req)
+				size += len(req.peers)
+			case <-timer.C:
+				break collect
+			case <-b.stop:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.flush(pending)
+	}
+}
+
+// flush applies pending requests in one update. If the combined update
+// fails, each request is retried on its own so callers receive their own
+// result rather than a neighbour's error.
+func (b *batcher) flush(pending []batchRequest) {
+	var cfg wgtypes.Config
+	for _, req := range pending {
+		cfg.Peers = append(cfg.Peers, req.peers...)
+	}
+	err := b.apply(cfg)
+	if err == nil || len(pending) == 1 {
+		for _, req := range pending {
+			req.result <- err
+		}
+		return
+	}
+	for _, req := range pending {
+		req.result <- b.apply(wgtypes.Config{Peers: req.peers})
+	}
+}
@@ -0,0 +1,114 @@
+package wg
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func addPeersConcurrently(t *testing.T, mgr *Manager, n int) []error {
+	t.Helper()
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		allowed, err := AllowedIPNet(net.IPv4(10, 0, 0, byte(i+1)))
+		if err != nil {
+			t.Fatalf("allowed ip: %v", err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = mgr.AddPeer(key.PublicKey(), nil, []net.IPNet{allowed})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBatchingCoalescesUpdates(t *testing.T) {
+	device := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(device, "wg0", 0)
+	mgr.EnableBatching(50 * time.Millisecond)
+	defer mgr.Close()
+
+	for i, err := range addPeersConcurrently(t, mgr, 20) {
+		if err != nil {
+			t.Fatalf("AddPeer %d: %v", i, err)
+		}
+	}
+
+	if got := len(device.Peers()); got != 20 {
+		t.Fatalf("expected 20 peers, got %d", got)
+	}
+	if got := len(device.Configs()); got >= 20 {
+		t.Fatalf("expected updates to be coalesced, got %d device updates", got)
+	}
+}
+
+func TestBatchingReportsPerRequestErrors(t *testing.T) {
+	injected := errors.New("invalid peer")
+	pending := make([]batchRequest, 5)
+	for i := range pending {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		pending[i] = batchRequest{
+			peers:  []wgtypes.PeerConfig{{PublicKey: key.PublicKey()}},
+			result: make(chan error, 1),
+		}
+	}
+	invalid := pending[2].peers[0].PublicKey
+
+	// The combined update is rejected because it contains the invalid
+	// peer; the individual retries fail only for that peer.
+	var applied []int
+	b := &batcher{apply: func(cfg wgtypes.Config) error {
+		applied = append(applied, len(cfg.Peers))
+		for _, peer := range cfg.Peers {
+			if peer.PublicKey == invalid {
+				return injected
+			}
+		}
+		return nil
+	}}
+	b.flush(pending)
+
+	for i, req := range pending {
+		err := <-req.result
+		if i == 2 {
+			if !errors.Is(err, injected) {
+				t.Fatalf("request %d: expected injected error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+	}
+	if len(applied) != 1+len(pending) || applied[0] != len(pending) {
+		t.Fatalf("expected one combined update and %d retries, got %v", len(pending), applied)
+	}
+}
+
+func TestBatchingRejectsAfterClose(t *testing.T) {
+	mgr := NewManagerWithClient(NewFakeDevice("wg0"), "wg0", 0)
+	mgr.EnableBatching(time.Millisecond)
+	mgr.Close()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	if err := mgr.RemovePeer(key.PublicKey()); !errors.Is(err, errManagerClosed) {
+		t.Fatalf("expected errManagerClosed, got %v", err)
+	}
+}
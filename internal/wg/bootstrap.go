@@ -0,0 +1,167 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// InterfaceConfig describes an interface the gateway creates and owns.
+type InterfaceConfig struct {
+	PrivateKeyPath string
+	ListenPort     int
+	FirewallMark   int
+	Address        string
+	MTU            int
+}
+
+// Host link operations; tests replace them.
+var (
+	linkEnsure    = ensureLink
+	linkConfigure = configureLink
+	linkDelete    = deleteLink
+	linkAddRoutes = addRoutes
+)
+
+// Bootstrap creates the interface if it does not exist, applies the server
+// key, listen port and firewall mark, assigns the address and brings the link up.
+// Userspace devices already exist, so only the device settings are applied.
+// A link created by this call is deleted again when a later step fails.
+func (m *Manager) Bootstrap(cfg InterfaceConfig) (err error) {
+	if m.kernel {
+		var created bool
+		created, err = linkEnsure(m.iface)
+		if err != nil {
+			return fmt.Errorf("create link %s: %w", m.iface, err)
+		}
+		if created {
+			defer func() {
+				if err == nil {
+					m.created = true
+					return
+				}
+				if delErr := linkDelete(m.iface); delErr != nil {
+					err = errors.Join(err, fmt.Errorf("delete link %s: %w", m.iface, delErr))
+				}
+			}()
+		}
+	}
+
+	key, err := m.serverKey(cfg.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	devCfg := wgtypes.Config{PrivateKey: key}
+	if cfg.ListenPort > 0 {
+		port := cfg.ListenPort
+		devCfg.ListenPort = &port
+	}
+	if cfg.FirewallMark > 0 {
+		mark := cfg.FirewallMark
+		devCfg.FirewallMark = &mark
+	}
+	if err := m.client.ConfigureDevice(m.iface, devCfg); err != nil {
+		return fmt.Errorf("configure device: %w", err)
+	}
+
+	if m.kernel || isTUN(m.client) {
+		if err := linkConfigure(m.iface, cfg.Address, cfg.MTU); err != nil {
+			return fmt.Errorf("configure link %s: %w", m.iface, err)
+		}
+	}
+	return nil
+}
+
+// addRoutes routes nets through the interface. Only host links need routes;
+// an in-process network stack delivers to its own peers.
+func (m *Manager) addRoutes(nets []net.IPNet) error {
+	if len(nets) == 0 || !(m.kernel || isTUN(m.client)) {
+		return nil
+	}
+	if err := linkAddRoutes(m.iface, nets); err != nil {
+		return fmt.Errorf("route peer through %s: %w", m.iface, err)
+	}
+	return nil
+}
+
+func isTUN(client Client) bool {
+	u, ok := client.(*UserspaceDevice)
+	return ok && u.tun
+}
+
+// Teardown deletes the interface if it was created by Bootstrap.
+func (m *Manager) Teardown() error {
+	if !m.created {
+		return nil
+	}
+	if err := linkDelete(m.iface); err != nil {
+		return fmt.Errorf("delete link %s: %w", m.iface, err)
+	}
+	m.created = false
+	return nil
+}
+
+// serverKey returns the private key to apply to the device. A key stored at
+// path is loaded, or generated and persisted when the file does not exist.
+// Without a path the device keeps its current key, or gets an ephemeral one.
+func (m *Manager) serverKey(path string) (*wgtypes.Key, error) {
+	if path == "" {
+		device, err := m.client.Device(m.iface)
+		if err == nil && device.PrivateKey != (wgtypes.Key{}) {
+			return nil, nil
+		}
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("generate server key: %w", err)
+		}
+		return &key, nil
+	}
+
+	key, err := LoadPrivateKey(path)
+	if err == nil {
+		return &key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err = wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("generate server key: %w", err)
+	}
+	if err := SavePrivateKey(path, key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// LoadPrivateKey reads a base64 encoded private key from path.
+func LoadPrivateKey(path string) (wgtypes.Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("read private key: %w", err)
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(content)))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("parse private key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// SavePrivateKey writes key to path with owner-only permissions.
+func SavePrivateKey(path string, key wgtypes.Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(key.String()+"\n"), 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package wg
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSaveAndLoadPrivateKey(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "keys", "server.key")
+
+	if err := SavePrivateKey(path, key); err != nil {
+		t.Fatalf("SavePrivateKey: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat key: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	dirInfo, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("stat key directory: %v", err)
+	}
+	if dirInfo.Mode().Perm() != 0o700 {
+		t.Fatalf("expected directory mode 0700, got %v", dirInfo.Mode().Perm())
+	}
+
+	loaded, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey: %v", err)
+	}
+	if loaded != key {
+		t.Fatalf("expected loaded key to match saved key")
+	}
+}
+
+func TestLoadPrivateKeyErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := LoadPrivateKey(filepath.Join(dir, "missing.key")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.key")
+	if err := os.WriteFile(invalid, []byte("not a key\n"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if _, err := LoadPrivateKey(invalid); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+}
+
+func TestLoadPrivateKeyTrimsWhitespace(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "server.key")
+	if err := os.WriteFile(path, []byte("  "+key.String()+"\r\n\n"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	loaded, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey: %v", err)
+	}
+	if loaded != key {
+		t.Fatalf("expected loaded key to match")
+	}
+}
+
+// stubLinks replaces the host link operations for the duration of a test.
+func stubLinks(t *testing.T, ensure func(string) (bool, error), configure func(string, string, int) error, del func(string) error) {
+	t.Helper()
+	prevEnsure, prevConfigure, prevDelete := linkEnsure, linkConfigure, linkDelete
+	linkEnsure, linkConfigure, linkDelete = ensure, configure, del
+	t.Cleanup(func() {
+		linkEnsure, linkConfigure, linkDelete = prevEnsure, prevConfigure, prevDelete
+	})
+}
+
+func TestBootstrapDeletesCreatedLinkOnFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fail      func(device *FakeDevice)
+		configure error
+	}{
+		{name: "configure device", fail: func(device *FakeDevice) {
+			device.FailNext(FakeOpConfigure, errors.New("netlink busy"))
+		}},
+		{name: "configure link", configure: errors.New("address in use")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var deleted []string
+			stubLinks(t,
+				func(string) (bool, error) { return true, nil },
+				func(string, string, int) error { return tc.configure },
+				func(iface string) error {
+					deleted = append(deleted, iface)
+					return nil
+				},
+			)
+			device := NewFakeDevice("wg0")
+			if tc.fail != nil {
+				tc.fail(device)
+			}
+			m := NewManagerWithClient(device, "wg0", 0)
+			m.kernel = true
+
+			if err := m.Bootstrap(InterfaceConfig{}); err == nil {
+				t.Fatalf("expected Bootstrap to fail")
+			}
+			if len(deleted) != 1 || deleted[0] != "wg0" {
+				t.Fatalf("expected the created link deleted, got %v", deleted)
+			}
+			if m.created {
+				t.Fatalf("expected the link not recorded as created")
+			}
+		})
+	}
+}
+
+func TestBootstrapKeepsCreatedLink(t *testing.T) {
+	var deleted []string
+	stubLinks(t,
+		func(string) (bool, error) { return true, nil },
+		func(string, string, int) error { return nil },
+		func(iface string) error {
+			deleted = append(deleted, iface)
+			return nil
+		},
+	)
+	m := NewManagerWithClient(NewFakeDevice("wg0"), "wg0", 0)
+	m.kernel = true
+
+	if err := m.Bootstrap(InterfaceConfig{}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if len(deleted) != 0 || !m.created {
+		t.Fatalf("expected the link kept and recorded, deleted %v", deleted)
+	}
+	if err := m.Teardown(); err != nil || len(deleted) != 1 {
+		t.Fatalf("expected Teardown to delete the link, got %v %v", err, deleted)
+	}
+}
@@ -0,0 +1,258 @@
+package wg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FakeOp identifies a FakeDevice operation for fault injection.
+type FakeOp string
+
+// Operations that can be failed with FakeDevice.FailNext.
+const (
+	FakeOpDevice    FakeOp = "device"
+	FakeOpConfigure FakeOp = "configure"
+)
+
+// ErrFakeClosed is returned by a FakeDevice after Close.
+var ErrFakeClosed = errors.New("fake device closed")
+
+// FakeDevice is an in-memory Client for tests. It applies configurations
+// with kernel semantics, records every successful ConfigureDevice call,
+// and lets tests simulate handshakes, traffic and failures.
+type FakeDevice struct {
+	mu           sync.Mutex
+	name         string
+	privateKey   wgtypes.Key
+	listenPort   int
+	firewallMark int
+	peers        map[wgtypes.Key]*wgtypes.Peer
+	configs      []wgtypes.Config
+	failures     map[FakeOp][]error
+	closed       bool
+}
+
+// NewFakeDevice constructs an empty fake device named name.
+func NewFakeDevice(name string) *FakeDevice {
+	return &FakeDevice{
+		name:     name,
+		peers:    make(map[wgtypes.Key]*wgtypes.Peer),
+		failures: make(map[FakeOp][]error),
+	}
+}
+
+// FailNext makes the next call of op return err without side effects.
+// Repeated calls queue errors for subsequent calls.
+func (f *FakeDevice) FailNext(op FakeOp, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], err)
+}
+
+// Device returns a snapshot of the device and its peers.
+func (f *FakeDevice) Device(name string) (*wgtypes.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(FakeOpDevice, name); err != nil {
+		return nil, err
+	}
+
+	device := &wgtypes.Device{
+		Name:         f.name,
+		Type:         wgtypes.Unknown,
+		PrivateKey:   f.privateKey,
+		ListenPort:   f.listenPort,
+		FirewallMark: f.firewallMark,
+		Peers:        f.snapshot(),
+	}
+	if f.privateKey != (wgtypes.Key{}) {
+		device.PublicKey = f.privateKey.PublicKey()
+	}
+	return device, nil
+}
+
+// ConfigureDevice applies cfg and records it.
+func (f *FakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(FakeOpConfigure, name); err != nil {
+		return err
+	}
+
+	if cfg.PrivateKey != nil {
+		f.privateKey = *cfg.PrivateKey
+	}
+	if cfg.ListenPort != nil {
+		f.listenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		f.firewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		f.peers = make(map[wgtypes.Key]*wgtypes.Peer)
+	}
+
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			delete(f.peers, pc.PublicKey)
+			continue
+		}
+		peer, ok := f.peers[pc.PublicKey]
+		if !ok {
+			if pc.UpdateOnly {
+				continue
+			}
+			peer = &wgtypes.Peer{PublicKey: pc.PublicKey, ProtocolVersion: 1}
+			f.peers[pc.PublicKey] = peer
+		}
+		if pc.PresharedKey != nil {
+			peer.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			endpoint := *pc.Endpoint
+			peer.Endpoint = &endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		for _, allowed := range pc.AllowedIPs {
+			f.claimAllowedIP(peer, allowed)
+		}
+	}
+
+	f.configs = append(f.configs, cfg)
+	return nil
+}
+
+// Close marks the device closed; later calls fail with ErrFakeClosed.
+func (f *FakeDevice) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Configs returns every configuration applied so far.
+func (f *FakeDevice) Configs() []wgtypes.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]wgtypes.Config, len(f.configs))
+	copy(out, f.configs)
+	return out
+}
+
+// Peers returns the current peers ordered by public key.
+func (f *FakeDevice) Peers() []wgtypes.Peer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshot()
+}
+
+// Peer returns the current state of the peer with the given public key.
+func (f *FakeDevice) Peer(publicKey wgtypes.Key) (wgtypes.Peer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return wgtypes.Peer{}, false
+	}
+	return copyPeer(peer), true
+}
+
+// Handshake simulates a completed handshake with the peer at t, optionally
+// from endpoint.
+func (f *FakeDevice) Handshake(publicKey wgtypes.Key, t time.Time, endpoint *net.UDPAddr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return fmt.Errorf("peer %s: %w", publicKey, os.ErrNotExist)
+	}
+	peer.LastHandshakeTime = t
+	if endpoint != nil {
+		ep := *endpoint
+		peer.Endpoint = &ep
+	}
+	return nil
+}
+
+// Transfer adds received and transmitted bytes to the peer's counters.
+func (f *FakeDevice) Transfer(publicKey wgtypes.Key, rx, tx int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return fmt.Errorf("peer %s: %w", publicKey, os.ErrNotExist)
+	}
+	peer.ReceiveBytes += rx
+	peer.TransmitBytes += tx
+	return nil
+}
+
+// check validates the device name and pops an injected failure for op.
+// The caller must hold f.mu.
+func (f *FakeDevice) check(op FakeOp, name string) error {
+	if f.closed {
+		return ErrFakeClosed
+	}
+	if name != f.name {
+		return fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+	}
+	if queued := f.failures[op]; len(queued) > 0 {
+		f.failures[op] = queued[1:]
+		return queued[0]
+	}
+	return nil
+}
+
+// claimAllowedIP assigns allowed to peer, removing it from any other peer
+// as the kernel does. The caller must hold f.mu.
+func (f *FakeDevice) claimAllowedIP(peer *wgtypes.Peer, allowed net.IPNet) {
+	for _, other := range f.peers {
+		kept := other.AllowedIPs[:0]
+		for _, existing := range other.AllowedIPs {
+			if !sameIPNet(existing, allowed) {
+				kept = append(kept, existing)
+			}
+		}
+		other.AllowedIPs = kept
+	}
+	peer.AllowedIPs = append(peer.AllowedIPs, allowed)
+}
+
+// snapshot copies the peers. The caller must hold f.mu.
+func (f *FakeDevice) snapshot() []wgtypes.Peer {
+	out := make([]wgtypes.Peer, 0, len(f.peers))
+	for _, peer := range f.peers {
+		out = append(out, copyPeer(peer))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i].PublicKey[:], out[j].PublicKey[:]) < 0
+	})
+	return out
+}
+
+func copyPeer(peer *wgtypes.Peer) wgtypes.Peer {
+	cp := *peer
+	cp.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+	if peer.Endpoint != nil {
+		ep := *peer.Endpoint
+		cp.Endpoint = &ep
+	}
+	return cp
+}
+
+func sameIPNet(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
@@ -0,0 +1,81 @@
+package wg
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestFakeDeviceManagerRoundTrip(t *testing.T) {
+	device := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(device, "wg0", 0)
+
+	first, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	second, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	allowed, err := AllowedIPNet(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+
+	if err := mgr.AddPeer(first.PublicKey(), nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if err := mgr.AddPeer(second.PublicKey(), nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if peer, _ := device.Peer(first.PublicKey()); len(peer.AllowedIPs) != 0 {
+		t.Fatalf("expected allowed ip moved to second peer, first still has %v", peer.AllowedIPs)
+	}
+
+	at := time.Unix(1700000000, 0)
+	if err := device.Handshake(second.PublicKey(), at, nil); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	stats, err := mgr.PeerStats()
+	if err != nil {
+		t.Fatalf("PeerStats: %v", err)
+	}
+	if got := stats[second.PublicKey().String()].LastHandshake; !got.Equal(at) {
+		t.Fatalf("expected handshake %s, got %s", at, got)
+	}
+
+	endpoint := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 51820}
+	if err := device.Handshake(first.PublicKey(), at, endpoint); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if err := device.Transfer(first.PublicKey(), 10, 20); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	stats, err = mgr.PeerStats()
+	if err != nil {
+		t.Fatalf("PeerStats: %v", err)
+	}
+	want := PeerStats{LastHandshake: at, Endpoint: "198.51.100.7:51820", ReceiveBytes: 10, TransmitBytes: 20}
+	if got := stats[first.PublicKey().String()]; !got.LastHandshake.Equal(at) || got.Endpoint != want.Endpoint || got.ReceiveBytes != 10 || got.TransmitBytes != 20 {
+		t.Fatalf("expected stats %+v, got %+v", want, got)
+	}
+
+	injected := errors.New("boom")
+	device.FailNext(FakeOpConfigure, injected)
+	if err := mgr.RemovePeer(first.PublicKey()); !errors.Is(err, injected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if len(device.Peers()) != 2 {
+		t.Fatalf("expected failed removal to leave peers untouched")
+	}
+	if err := mgr.RemovePeer(first.PublicKey()); err != nil {
+		t.Fatalf("RemovePeer: %v", err)
+	}
+	if len(device.Configs()) != 3 {
+		t.Fatalf("expected 3 recorded configs, got %d", len(device.Configs()))
+	}
+}
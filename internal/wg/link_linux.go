@@ -0,0 +1,87 @@
+//go:build linux
+
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ensureLink creates a wireguard link named iface unless it already exists.
+// It reports whether the link was created.
+func ensureLink(iface string) (bool, error) {
+	_, err := netlink.LinkByName(iface)
+	if err == nil {
+		return false, nil
+	}
+	var notFound netlink.LinkNotFoundError
+	if !errors.As(err, &notFound) {
+		return false, err
+	}
+
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: iface}}
+	if err := netlink.LinkAdd(link); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// configureLink assigns address (in CIDR notation) and mtu, then brings the link up.
+func configureLink(iface, address string, mtu int) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+
+	if address != "" {
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return fmt.Errorf("parse address %q: %w", address, err)
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("assign address: %w", err)
+		}
+	}
+
+	if mtu > 0 {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("set mtu: %w", err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set link up: %w", err)
+	}
+	return nil
+}
+
+func deleteLink(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// addRoutes routes each of nets through iface, replacing existing routes to
+// the same destination.
+func addRoutes(iface string, nets []net.IPNet) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	for _, dst := range nets {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &dst,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("add route %s: %w", dst.String(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package wg
+
+import (
+	"errors"
+	"net"
+)
+
+var errLinkUnsupported = errors.New("interface management requires linux")
+
+func ensureLink(iface string) (bool, error) {
+	return false, errLinkUnsupported
+}
+
+func configureLink(iface, address string, mtu int) error {
+	return errLinkUnsupported
+}
+
+func deleteLink(iface string) error {
+	return errLinkUnsupported
+}
+
+func addRoutes(iface string, nets []net.IPNet) error {
+	return errLinkUnsupported
+}
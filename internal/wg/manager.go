@@ -9,11 +9,25 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Client is the device control surface a Manager drives. *wgctrl.Client
+// implements it for kernel and UAPI devices, UserspaceDevice for an
+// embedded wireguard-go device.
+type Client interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
 // Manager provides operations to manage WireGuard peers on an interface.
 type Manager struct {
-	client    *wgctrl.Client
+	client    Client
 	iface     string
 	keepalive *time.Duration
+	// kernel reports whether the interface is a host link that Bootstrap
+	// creates and configures through netlink.
+	kernel  bool
+	created bool
+	batch   *batcher
 }
 
 // NewManager creates a Manager for the given interface name.
@@ -22,18 +36,40 @@ func NewManager(iface string, keepaliveSeconds int) (*Manager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create wgctrl client: %w", err)
 	}
+	m := NewManagerWithClient(client, iface, keepaliveSeconds)
+	m.kernel = true
+	return m, nil
+}
+
+// NewManagerWithClient creates a Manager that controls iface through client.
+// The Manager takes ownership of client and closes it on Close.
+func NewManagerWithClient(client Client, iface string, keepaliveSeconds int) *Manager {
 	var keepalive *time.Duration
 	if keepaliveSeconds > 0 {
 		d := time.Duration(keepaliveSeconds) * time.Second
 		keepalive = &d
 	}
-	return &Manager{client: client, iface: iface, keepalive: keepalive}, nil
+	return &Manager{client: client, iface: iface, keepalive: keepalive}
+}
+
+// EnableBatching coalesces peer updates issued within window into a single
+// device configuration. It must be called before the Manager is shared.
+func (m *Manager) EnableBatching(window time.Duration) {
+	if window <= 0 || m.batch != nil {
+		return
+	}
+	m.batch = newBatcher(window, func(cfg wgtypes.Config) error {
+		return m.client.ConfigureDevice(m.iface, cfg)
+	})
 }
 
 // Close releases underlying resources.
 func (m *Manager) Close() error {
+	if m.batch != nil {
+		m.batch.close()
+	}
 	if m.client != nil {
-		m.client.Close()
+		return m.client.Close()
 	}
 	return nil
 }
@@ -48,50 +84,124 @@ func (m *Manager) VerifyInterface() error {
 
 // AddPeer adds a peer to the WireGuard device.
 func (m *Manager) AddPeer(publicKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error {
-	cfg := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{{
-			PublicKey:                   publicKey,
+	peers := []wgtypes.PeerConfig{{
+		PublicKey:                   publicKey,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  allowedIPs,
+		PresharedKey:                preshared,
+		PersistentKeepaliveInterval: m.keepalive,
+	}}
+	if err := m.configurePeers(peers); err != nil {
+		return fmt.Errorf("configure device: %w", err)
+	}
+	return nil
+}
+
+// ReplacePeer moves allowedIPs from the peer with oldKey to a new peer with
+// newKey and removes the old peer in a single device update.
+func (m *Manager) ReplacePeer(oldKey, newKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error {
+	peers := []wgtypes.PeerConfig{
+		{
+			PublicKey:                   newKey,
 			ReplaceAllowedIPs:           true,
 			AllowedIPs:                  allowedIPs,
 			PresharedKey:                preshared,
 			PersistentKeepaliveInterval: m.keepalive,
-		}},
+		},
+		{PublicKey: oldKey, Remove: true},
 	}
-	if err := m.client.ConfigureDevice(m.iface, cfg); err != nil {
-		return fmt.Errorf("configure device: %w", err)
+	if err := m.configurePeers(peers); err != nil {
+		return fmt.Errorf("replace peer: %w", err)
 	}
 	return nil
 }
 
 // RemovePeer removes a peer by its public key.
 func (m *Manager) RemovePeer(publicKey wgtypes.Key) error {
-	cfg := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{{
-			PublicKey: publicKey,
-			Remove:    true,
-		}},
+	return m.RemovePeers([]wgtypes.Key{publicKey})
+}
+
+// RemovePeers removes several peers in a single device update.
+func (m *Manager) RemovePeers(publicKeys []wgtypes.Key) error {
+	if len(publicKeys) == 0 {
+		return nil
 	}
-	if err := m.client.ConfigureDevice(m.iface, cfg); err != nil {
+	peers := make([]wgtypes.PeerConfig, 0, len(publicKeys))
+	for _, key := range publicKeys {
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+	if err := m.configurePeers(peers); err != nil {
 		return fmt.Errorf("remove peer: %w", err)
 	}
 	return nil
 }
 
-// Handshakes returns the last handshake times for peers keyed by their public key string.
-func (m *Manager) Handshakes() (map[string]time.Time, error) {
+// configurePeers applies peer changes, through the batcher when enabled.
+func (m *Manager) configurePeers(peers []wgtypes.PeerConfig) error {
+	if m.batch != nil {
+		return m.batch.submit(peers)
+	}
+	return m.client.ConfigureDevice(m.iface, wgtypes.Config{Peers: peers})
+}
+
+// PeerStats holds what the device reports about a peer's connection.
+type PeerStats struct {
+	// LastHandshake is zero when the peer never completed a handshake.
+	LastHandshake time.Time
+	// Endpoint is the peer's current remote address, empty when unknown.
+	Endpoint      string
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// PeerStats returns the connection details of every peer keyed by its public
+// key string.
+func (m *Manager) PeerStats() (map[string]PeerStats, error) {
 	device, err := m.client.Device(m.iface)
 	if err != nil {
 		return nil, fmt.Errorf("load device: %w", err)
 	}
-	result := make(map[string]time.Time, len(device.Peers))
+	result := make(map[string]PeerStats, len(device.Peers))
 	for _, peer := range device.Peers {
-		if peer.PublicKey != (wgtypes.Key{}) {
-			result[peer.PublicKey.String()] = peer.LastHandshakeTime
+		if peer.PublicKey == (wgtypes.Key{}) {
+			continue
+		}
+		stats := PeerStats{
+			LastHandshake: peer.LastHandshakeTime,
+			ReceiveBytes:  peer.ReceiveBytes,
+			TransmitBytes: peer.TransmitBytes,
+		}
+		if peer.Endpoint != nil {
+			stats.Endpoint = peer.Endpoint.String()
 		}
+		result[peer.PublicKey.String()] = stats
 	}
 	return result, nil
 }
 
+// DeviceInfo holds the server-side values clients need to reach the interface.
+type DeviceInfo struct {
+	PublicKey  wgtypes.Key
+	ListenPort int
+	MTU        int
+}
+
+// Info reads the device's public key, listen port and MTU. The MTU is zero
+// when it cannot be determined.
+func (m *Manager) Info() (DeviceInfo, error) {
+	device, err := m.client.Device(m.iface)
+	if err != nil {
+		return DeviceInfo{}, fmt.Errorf("load device: %w", err)
+	}
+	info := DeviceInfo{PublicKey: device.PublicKey, ListenPort: device.ListenPort}
+	if u, ok := m.client.(*UserspaceDevice); ok {
+		info.MTU = u.MTU()
+	} else if link, err := net.InterfaceByName(m.iface); err == nil {
+		info.MTU = link.MTU
+	}
+	return info, nil
+}
+
 // Interface returns the managed interface name.
 func (m *Manager) Interface() string {
 	return m.iface
@@ -0,0 +1,368 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ErrRotationInProgress indicates that the new key is still being served on
+// the overlap interface.
+var ErrRotationInProgress = errors.New("key rotation overlap still active")
+
+// finishRetry is how long a cutover that could not read the overlap
+// interface or update the managed one waits before trying again.
+const finishRetry = time.Minute
+
+// RotationConfig configures server key rotation for a Manager.
+type RotationConfig struct {
+	// OverlapInterface serves the new key while the previous key stays on
+	// the managed interface.
+	OverlapInterface string
+	// OverlapListenPort is the port the new key is served on. Once the
+	// grace period ends the managed interface moves to it, and the next
+	// rotation uses the interface's former port for the overlap.
+	OverlapListenPort int
+	// Grace is how long the previous key stays reachable.
+	Grace time.Duration
+	// PrivateKeyPath, when set, receives the new key.
+	PrivateKeyPath string
+	// NewOverlap creates the Manager for a fresh, empty OverlapInterface.
+	// Host links should carry the interface's address, so that the
+	// gateway can be reached through them.
+	NewOverlap func() (*Manager, error)
+}
+
+// Rotation describes a started key rotation.
+type Rotation struct {
+	PublicKey         wgtypes.Key
+	PreviousPublicKey wgtypes.Key
+	OverlapInterface  string
+	OverlapListenPort int
+	OverlapUntil      time.Time
+}
+
+// KeyRotator replaces a Manager's server key without cutting off existing
+// clients. A rotation brings up the new key on an overlap interface and
+// port, while the previous key keeps serving every existing peer on the
+// managed interface. New peers are placed on the overlap interface and
+// existing peers follow with MovePeer as they fetch a config for the new
+// key. When the grace period ends the managed interface takes over the new
+// key, the overlap port and the moved peers, and the overlap interface is
+// removed.
+//
+// KeyRotator forwards peer operations to whichever interface holds the
+// peer, so it is used in place of the Manager it rotates.
+type KeyRotator struct {
+	manager *Manager
+	cfg     RotationConfig
+
+	mu sync.RWMutex
+	// overlap serves the new key during a rotation; nil otherwise.
+	overlap *Manager
+	timer   *time.Timer
+	// homePort is the managed interface's port before its first rotation,
+	// which later rotations alternate with OverlapListenPort.
+	homePort int
+}
+
+// NewKeyRotator constructs a rotator for m.
+func NewKeyRotator(m *Manager, cfg RotationConfig) *KeyRotator {
+	return &KeyRotator{manager: m, cfg: cfg}
+}
+
+// Rotate generates a new server key and serves it on the overlap interface
+// until the grace period ends.
+func (r *KeyRotator) Rotate() (Rotation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A pending timer is a cutover still moving the listen port.
+	if r.overlap != nil || r.timer != nil {
+		return Rotation{}, ErrRotationInProgress
+	}
+
+	device, err := r.manager.client.Device(r.manager.iface)
+	if err != nil {
+		return Rotation{}, fmt.Errorf("load device: %w", err)
+	}
+	port := r.cfg.OverlapListenPort
+	if device.ListenPort != port {
+		r.homePort = device.ListenPort
+	} else if port = r.homePort; port == 0 {
+		return Rotation{}, errors.New("no listen port free for the overlap interface")
+	}
+
+	next, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return Rotation{}, fmt.Errorf("generate server key: %w", err)
+	}
+
+	overlap, err := r.cfg.NewOverlap()
+	if err != nil {
+		return Rotation{}, fmt.Errorf("create overlap interface: %w", err)
+	}
+	overlapCfg := wgtypes.Config{
+		PrivateKey:   &next,
+		ListenPort:   &port,
+		ReplacePeers: true,
+	}
+	if err := overlap.client.ConfigureDevice(overlap.iface, overlapCfg); err != nil {
+		r.retire(overlap)
+		return Rotation{}, fmt.Errorf("configure overlap interface: %w", err)
+	}
+
+	if r.cfg.PrivateKeyPath != "" {
+		if err := SavePrivateKey(r.cfg.PrivateKeyPath, next); err != nil {
+			r.retire(overlap)
+			return Rotation{}, err
+		}
+	}
+
+	r.overlap = overlap
+	r.timer = time.AfterFunc(r.cfg.Grace, r.finish)
+
+	return Rotation{
+		PublicKey:         next.PublicKey(),
+		PreviousPublicKey: device.PublicKey,
+		OverlapInterface:  r.cfg.OverlapInterface,
+		OverlapListenPort: port,
+		OverlapUntil:      time.Now().Add(r.cfg.Grace).UTC(),
+	}, nil
+}
+
+// MovePeer moves a peer from the managed interface to the overlap
+// interface, for a client that received a config with the new key. It does
+// nothing outside a rotation or when the peer is not on the managed
+// interface.
+func (r *KeyRotator) MovePeer(publicKey wgtypes.Key) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.overlap == nil {
+		return nil
+	}
+
+	device, err := r.manager.client.Device(r.manager.iface)
+	if err != nil {
+		return fmt.Errorf("load device: %w", err)
+	}
+	var peers []wgtypes.Peer
+	for _, peer := range device.Peers {
+		if peer.PublicKey == publicKey {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	if err := r.overlap.configurePeers(copyPeerConfigs(peers)); err != nil {
+		return fmt.Errorf("add peer to overlap interface: %w", err)
+	}
+	if err := r.overlap.addRoutes(peers[0].AllowedIPs); err != nil {
+		r.overlap.RemovePeer(publicKey)
+		return err
+	}
+	if err := r.manager.RemovePeer(publicKey); err != nil {
+		r.overlap.RemovePeer(publicKey)
+		return err
+	}
+	return nil
+}
+
+// AddPeer adds a peer to the interface serving the newest key.
+func (r *KeyRotator) AddPeer(publicKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.overlap == nil {
+		return r.manager.AddPeer(publicKey, preshared, allowedIPs)
+	}
+	if err := r.overlap.AddPeer(publicKey, preshared, allowedIPs); err != nil {
+		return err
+	}
+	if err := r.overlap.addRoutes(allowedIPs); err != nil {
+		r.overlap.RemovePeer(publicKey)
+		return err
+	}
+	return nil
+}
+
+// ReplacePeer replaces a peer like Manager.ReplacePeer. During a rotation
+// the new peer is placed on the overlap interface and the old one is
+// removed from both interfaces.
+func (r *KeyRotator) ReplacePeer(oldKey, newKey wgtypes.Key, preshared *wgtypes.Key, allowedIPs []net.IPNet) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.overlap == nil {
+		return r.manager.ReplacePeer(oldKey, newKey, preshared, allowedIPs)
+	}
+	if err := r.overlap.ReplacePeer(oldKey, newKey, preshared, allowedIPs); err != nil {
+		return err
+	}
+	if err := r.overlap.addRoutes(allowedIPs); err != nil {
+		r.overlap.RemovePeer(newKey)
+		return err
+	}
+	return r.manager.RemovePeer(oldKey)
+}
+
+// RemovePeer removes a peer from both interfaces.
+func (r *KeyRotator) RemovePeer(publicKey wgtypes.Key) error {
+	return r.RemovePeers([]wgtypes.Key{publicKey})
+}
+
+// RemovePeers removes several peers from both interfaces. Routes of peers
+// removed from the overlap interface stay until it is removed; addresses
+// handed out again during the rotation are routed there anyway.
+func (r *KeyRotator) RemovePeers(publicKeys []wgtypes.Key) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.manager.RemovePeers(publicKeys); err != nil {
+		return err
+	}
+	if r.overlap == nil {
+		return nil
+	}
+	return r.overlap.RemovePeers(publicKeys)
+}
+
+// PeerStats returns the statistics of the peers on both interfaces.
+func (r *KeyRotator) PeerStats() (map[string]PeerStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result, err := r.manager.PeerStats()
+	if err != nil || r.overlap == nil {
+		return result, err
+	}
+	overlap, err := r.overlap.PeerStats()
+	if err != nil {
+		return nil, err
+	}
+	for key, stats := range overlap {
+		result[key] = stats
+	}
+	return result, nil
+}
+
+// Info describes the interface serving the newest key.
+func (r *KeyRotator) Info() (DeviceInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.overlap == nil {
+		return r.manager.Info()
+	}
+	return r.overlap.Info()
+}
+
+// Close ends an active rotation immediately. The managed interface keeps
+// the previous key.
+func (r *KeyRotator) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if r.overlap != nil {
+		r.retire(r.overlap)
+		r.overlap = nil
+	}
+	return nil
+}
+
+// finish ends the grace period: the managed interface takes over the key,
+// the port and the peers of the overlap interface, which is removed. Peers
+// that were never moved stay on the managed interface and can connect once
+// they fetch a new config. The key and peers are installed first, so the
+// overlap keeps serving until they are in place; the port follows once the
+// overlap has released it. Failed steps are retried after finishRetry.
+func (r *KeyRotator) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.overlap == nil {
+		return
+	}
+	logger := slog.With("interface", r.manager.iface, "overlap_interface", r.overlap.iface)
+
+	device, err := r.overlap.client.Device(r.overlap.iface)
+	if err != nil {
+		logger.Error("read overlap interface, retrying", "error", err)
+		r.timer = time.AfterFunc(finishRetry, r.finish)
+		return
+	}
+	key := device.PrivateKey
+	cfg := wgtypes.Config{
+		PrivateKey: &key,
+		Peers:      copyPeerConfigs(device.Peers),
+	}
+	if err := r.manager.client.ConfigureDevice(r.manager.iface, cfg); err != nil {
+		logger.Error("install rotated server key, retrying", "error", err)
+		r.timer = time.AfterFunc(finishRetry, r.finish)
+		return
+	}
+	r.retire(r.overlap)
+	r.overlap = nil
+	r.timer = nil
+	r.movePort(device.ListenPort, len(device.Peers))
+}
+
+// movePort moves the managed interface to the port the overlap interface
+// served the new key on, retrying after finishRetry on failure. The caller
+// must hold r.mu.
+func (r *KeyRotator) movePort(port, peers int) {
+	logger := slog.With("interface", r.manager.iface)
+	if err := r.manager.client.ConfigureDevice(r.manager.iface, wgtypes.Config{ListenPort: &port}); err != nil {
+		logger.Error("move listen port, retrying", "listen_port", port, "error", err)
+		var timer *time.Timer
+		timer = time.AfterFunc(finishRetry, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			// Close stopped the rotation meanwhile.
+			if r.timer != timer {
+				return
+			}
+			r.timer = nil
+			r.movePort(port, peers)
+		})
+		r.timer = timer
+		return
+	}
+	logger.Info("server key rotation finished", "listen_port", port, "peers", peers)
+}
+
+// retire tears down and closes an overlap Manager.
+func (r *KeyRotator) retire(overlap *Manager) {
+	if err := overlap.Teardown(); err != nil {
+		slog.Error("teardown overlap interface", "interface", overlap.iface, "error", err)
+	}
+	if err := overlap.Close(); err != nil {
+		slog.Error("close overlap interface", "interface", overlap.iface, "error", err)
+	}
+}
+
+// copyPeerConfigs converts device peers into configs that recreate them.
+func copyPeerConfigs(peers []wgtypes.Peer) []wgtypes.PeerConfig {
+	out := make([]wgtypes.PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		cfg := wgtypes.PeerConfig{
+			PublicKey:         peer.PublicKey,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        peer.AllowedIPs,
+		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			psk := peer.PresharedKey
+			cfg.PresharedKey = &psk
+		}
+		if peer.PersistentKeepaliveInterval > 0 {
+			keepalive := peer.PersistentKeepaliveInterval
+			cfg.PersistentKeepaliveInterval = &keepalive
+		}
+		out = append(out, cfg)
+	}
+	return out
+}
@@ -0,0 +1,311 @@
+package wg
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// addTestPeer adds a fresh peer with the given address through add.
+func addTestPeer(t *testing.T, add func(wgtypes.Key, *wgtypes.Key, []net.IPNet) error, ip string) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	allowed, err := AllowedIPNet(net.ParseIP(ip))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := add(key.PublicKey(), nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	return key.PublicKey()
+}
+
+func TestKeyRotatorServesNewKeyOnOverlap(t *testing.T) {
+	primary := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(primary, "wg0", 25)
+	if err := mgr.Bootstrap(InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	previous, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	existing := addTestPeer(t, mgr.AddPeer, "10.0.0.2")
+
+	var overlapDevice *FakeDevice
+	keyPath := filepath.Join(t.TempDir(), "server.key")
+	rotator := NewKeyRotator(mgr, RotationConfig{
+		OverlapInterface:  "wg0-next",
+		OverlapListenPort: 51900,
+		Grace:             time.Hour,
+		PrivateKeyPath:    keyPath,
+		NewOverlap: func() (*Manager, error) {
+			overlapDevice = NewFakeDevice("wg0-next")
+			return NewManagerWithClient(overlapDevice, "wg0-next", 25), nil
+		},
+	})
+	defer rotator.Close()
+
+	rotation, err := rotator.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if rotation.PreviousPublicKey != previous.PublicKey || rotation.PublicKey == previous.PublicKey {
+		t.Fatalf("unexpected rotation keys %s -> %s", rotation.PreviousPublicKey, rotation.PublicKey)
+	}
+	if rotation.OverlapListenPort != 51900 {
+		t.Fatalf("expected overlap on port 51900, got %d", rotation.OverlapListenPort)
+	}
+	stored, err := LoadPrivateKey(keyPath)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey: %v", err)
+	}
+	if stored.PublicKey() != rotation.PublicKey {
+		t.Fatalf("expected new key persisted")
+	}
+
+	// Existing clients keep reaching the previous key on the primary.
+	current, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if current.PublicKey != previous.PublicKey || current.ListenPort != 51820 {
+		t.Fatalf("expected primary to keep previous key and port, got %s:%d", current.PublicKey, current.ListenPort)
+	}
+	if _, ok := primary.Peer(existing); !ok {
+		t.Fatalf("expected existing peer kept on primary")
+	}
+
+	info, err := rotator.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info.PublicKey != rotation.PublicKey || info.ListenPort != 51900 {
+		t.Fatalf("expected new configs to use overlap key and port, got %s:%d", info.PublicKey, info.ListenPort)
+	}
+
+	added := addTestPeer(t, rotator.AddPeer, "10.0.0.3")
+	if _, ok := overlapDevice.Peer(added); !ok {
+		t.Fatalf("expected new peer on overlap")
+	}
+	if _, ok := primary.Peer(added); ok {
+		t.Fatalf("expected new peer not on primary")
+	}
+
+	if err := rotator.MovePeer(existing); err != nil {
+		t.Fatalf("MovePeer: %v", err)
+	}
+	moved, ok := overlapDevice.Peer(existing)
+	if !ok || len(moved.AllowedIPs) != 1 || moved.PersistentKeepaliveInterval != 25*time.Second {
+		t.Fatalf("expected peer moved to overlap, got %+v", moved)
+	}
+	if _, ok := primary.Peer(existing); ok {
+		t.Fatalf("expected moved peer removed from primary")
+	}
+
+	stats, err := rotator.PeerStats()
+	if err != nil {
+		t.Fatalf("PeerStats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats for both peers, got %d", len(stats))
+	}
+
+	if _, err := rotator.Rotate(); !errors.Is(err, ErrRotationInProgress) {
+		t.Fatalf("expected ErrRotationInProgress, got %v", err)
+	}
+
+	// At the end of the grace period the primary takes over.
+	rotator.finish()
+	current, err = mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if current.PublicKey != rotation.PublicKey || current.ListenPort != 51900 {
+		t.Fatalf("expected primary on new key and port 51900, got %s:%d", current.PublicKey, current.ListenPort)
+	}
+	for _, key := range []wgtypes.Key{existing, added} {
+		if _, ok := primary.Peer(key); !ok {
+			t.Fatalf("expected peer %s back on primary", key)
+		}
+	}
+	if _, err := overlapDevice.Device("wg0-next"); !errors.Is(err, ErrFakeClosed) {
+		t.Fatalf("expected overlap closed, got %v", err)
+	}
+
+	// The next rotation uses the port the primary gave up.
+	rotation, err = rotator.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if rotation.OverlapListenPort != 51820 {
+		t.Fatalf("expected second overlap on port 51820, got %d", rotation.OverlapListenPort)
+	}
+}
+
+func TestKeyRotatorRetiresOverlapWhenSetupFails(t *testing.T) {
+	primary := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(primary, "wg0", 0)
+	if err := mgr.Bootstrap(InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	previous, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+
+	var overlapDevice *FakeDevice
+	failNext := true
+	rotator := NewKeyRotator(mgr, RotationConfig{
+		OverlapInterface:  "wg0-next",
+		OverlapListenPort: 51900,
+		Grace:             time.Hour,
+		NewOverlap: func() (*Manager, error) {
+			overlapDevice = NewFakeDevice("wg0-next")
+			if failNext {
+				overlapDevice.FailNext(FakeOpConfigure, errors.New("address in use"))
+				failNext = false
+			}
+			return NewManagerWithClient(overlapDevice, "wg0-next", 0), nil
+		},
+	})
+	defer rotator.Close()
+
+	if _, err := rotator.Rotate(); err == nil {
+		t.Fatalf("expected rotation to fail")
+	}
+	if _, err := overlapDevice.Device("wg0-next"); !errors.Is(err, ErrFakeClosed) {
+		t.Fatalf("expected overlap retired, got %v", err)
+	}
+	info, err := rotator.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info != previous {
+		t.Fatalf("expected primary unchanged, got %+v", info)
+	}
+	if _, err := rotator.Rotate(); err != nil {
+		t.Fatalf("expected retry to be allowed, got %v", err)
+	}
+}
+
+func TestKeyRotatorKeepsOverlapWhenCutoverFails(t *testing.T) {
+	primary := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(primary, "wg0", 0)
+	if err := mgr.Bootstrap(InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	previous, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+
+	var overlapDevice *FakeDevice
+	rotator := NewKeyRotator(mgr, RotationConfig{
+		OverlapInterface:  "wg0-next",
+		OverlapListenPort: 51900,
+		Grace:             time.Hour,
+		NewOverlap: func() (*Manager, error) {
+			overlapDevice = NewFakeDevice("wg0-next")
+			return NewManagerWithClient(overlapDevice, "wg0-next", 0), nil
+		},
+	})
+	defer rotator.Close()
+
+	rotation, err := rotator.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	added := addTestPeer(t, rotator.AddPeer, "10.0.0.3")
+
+	primary.FailNext(FakeOpConfigure, errors.New("netlink busy"))
+	rotator.finish()
+	if _, ok := overlapDevice.Peer(added); !ok {
+		t.Fatalf("expected the overlap kept serving its peers")
+	}
+	info, err := rotator.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info.PublicKey != rotation.PublicKey || info.ListenPort != 51900 {
+		t.Fatalf("expected new configs to keep using the overlap, got %s:%d", info.PublicKey, info.ListenPort)
+	}
+	if current, _ := mgr.Info(); current.PublicKey != previous.PublicKey {
+		t.Fatalf("expected primary to keep the previous key")
+	}
+	rotator.mu.RLock()
+	retry := rotator.timer != nil
+	rotator.mu.RUnlock()
+	if !retry {
+		t.Fatalf("expected the cutover rescheduled")
+	}
+
+	// The retry completes the cutover.
+	rotator.finish()
+	current, err := mgr.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if current.PublicKey != rotation.PublicKey || current.ListenPort != 51900 {
+		t.Fatalf("expected primary on new key and port 51900, got %s:%d", current.PublicKey, current.ListenPort)
+	}
+	if _, ok := primary.Peer(added); !ok {
+		t.Fatalf("expected peer moved to primary")
+	}
+}
+
+func TestKeyRotatorReplacePeerRollsBackOnRouteFailure(t *testing.T) {
+	prevAddRoutes := linkAddRoutes
+	linkAddRoutes = func(string, []net.IPNet) error { return errors.New("route exists") }
+	t.Cleanup(func() { linkAddRoutes = prevAddRoutes })
+
+	primary := NewFakeDevice("wg0")
+	mgr := NewManagerWithClient(primary, "wg0", 0)
+	if err := mgr.Bootstrap(InterfaceConfig{ListenPort: 51820}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	oldKey := addTestPeer(t, mgr.AddPeer, "10.0.0.2")
+
+	var overlapDevice *FakeDevice
+	rotator := NewKeyRotator(mgr, RotationConfig{
+		OverlapInterface:  "wg0-next",
+		OverlapListenPort: 51900,
+		Grace:             time.Hour,
+		NewOverlap: func() (*Manager, error) {
+			overlapDevice = NewFakeDevice("wg0-next")
+			overlap := NewManagerWithClient(overlapDevice, "wg0-next", 0)
+			// Route through a host link, so that addRoutes is attempted.
+			overlap.kernel = true
+			return overlap, nil
+		},
+	})
+	defer rotator.Close()
+	if _, err := rotator.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	next, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	allowed, err := AllowedIPNet(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := rotator.ReplacePeer(oldKey, next.PublicKey(), nil, []net.IPNet{allowed}); err == nil {
+		t.Fatalf("expected ReplacePeer to fail")
+	}
+	if _, ok := overlapDevice.Peer(next.PublicKey()); ok {
+		t.Fatalf("expected the new peer removed from the overlap")
+	}
+	if _, ok := primary.Peer(oldKey); !ok {
+		t.Fatalf("expected the old peer kept on the primary")
+	}
+}
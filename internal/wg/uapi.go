@@ -0,0 +1,172 @@
+package wg
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// uapiSet encodes cfg in the cross-platform configuration protocol used by
+// userspace WireGuard implementations.
+func uapiSet(cfg wgtypes.Config) string {
+	var b strings.Builder
+	if cfg.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", hexKey(*cfg.PrivateKey))
+	}
+	if cfg.ListenPort != nil {
+		fmt.Fprintf(&b, "listen_port=%d\n", *cfg.ListenPort)
+	}
+	if cfg.FirewallMark != nil {
+		fmt.Fprintf(&b, "fwmark=%d\n", *cfg.FirewallMark)
+	}
+	if cfg.ReplacePeers {
+		b.WriteString("replace_peers=true\n")
+	}
+
+	for _, peer := range cfg.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hexKey(peer.PublicKey))
+		if peer.Remove {
+			b.WriteString("remove=true\n")
+			continue
+		}
+		if peer.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+		if peer.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hexKey(*peer.PresharedKey))
+		}
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint.String())
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(peer.PersistentKeepaliveInterval.Seconds()))
+		}
+		if peer.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, allowed := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", allowed.String())
+		}
+	}
+	return b.String()
+}
+
+// uapiGet decodes the output of a configuration protocol "get" operation.
+func uapiGet(name, data string) (*wgtypes.Device, error) {
+	device := &wgtypes.Device{Name: name, Type: wgtypes.Userspace}
+	var peer *wgtypes.Peer
+	var handshakeSec, handshakeNsec int64
+
+	flushHandshake := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			peer.LastHandshakeTime = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed uapi line %q", line)
+		}
+
+		if key == "public_key" {
+			flushHandshake()
+			publicKey, err := parseHexKey(value)
+			if err != nil {
+				return nil, err
+			}
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: publicKey})
+			peer = &device.Peers[len(device.Peers)-1]
+			continue
+		}
+
+		if peer == nil {
+			switch key {
+			case "private_key":
+				privateKey, err := parseHexKey(value)
+				if err != nil {
+					return nil, err
+				}
+				device.PrivateKey = privateKey
+				device.PublicKey = privateKey.PublicKey()
+			case "listen_port":
+				port, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("parse listen_port: %w", err)
+				}
+				device.ListenPort = port
+			case "fwmark":
+				mark, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("parse fwmark: %w", err)
+				}
+				device.FirewallMark = mark
+			}
+			continue
+		}
+
+		var err error
+		switch key {
+		case "preshared_key":
+			peer.PresharedKey, err = parseHexKey(value)
+		case "endpoint":
+			peer.Endpoint, err = net.ResolveUDPAddr("udp", value)
+		case "last_handshake_time_sec":
+			handshakeSec, err = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.ReceiveBytes, err = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.TransmitBytes, err = strconv.ParseInt(value, 10, 64)
+		case "persistent_keepalive_interval":
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			peer.PersistentKeepaliveInterval = time.Duration(seconds) * time.Second
+		case "protocol_version":
+			peer.ProtocolVersion, err = strconv.Atoi(value)
+		case "allowed_ip":
+			var prefix netip.Prefix
+			prefix, err = netip.ParsePrefix(value)
+			if err == nil {
+				peer.AllowedIPs = append(peer.AllowedIPs, net.IPNet{
+					IP:   prefix.Addr().AsSlice(),
+					Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+				})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flushHandshake()
+	return device, nil
+}
+
+func hexKey(key wgtypes.Key) string {
+	return hex.EncodeToString(key[:])
+}
+
+func parseHexKey(value string) (wgtypes.Key, error) {
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("decode key: %w", err)
+	}
+	return wgtypes.NewKey(raw)
+}
@@ -0,0 +1,123 @@
+package wg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const defaultUserspaceMTU = 1420
+
+// UserspaceConfig describes an embedded wireguard-go device.
+type UserspaceConfig struct {
+	Name string
+	// Addresses are assigned to the netstack device. TUN devices are host
+	// links and get their address from Manager.Bootstrap instead.
+	Addresses []netip.Addr
+	MTU       int
+	// TUN creates a kernel TUN device instead of an in-process network
+	// stack. It requires CAP_NET_ADMIN but no WireGuard kernel module.
+	TUN bool
+}
+
+// UserspaceDevice runs WireGuard in-process. It satisfies Client so a
+// Manager can drive it exactly like a kernel device.
+type UserspaceDevice struct {
+	name   string
+	device *device.Device
+	net    *netstack.Net
+	tun    bool
+	mtu    int
+
+	closeOnce sync.Once
+}
+
+// NewUserspaceDevice starts a wireguard-go device.
+func NewUserspaceDevice(cfg UserspaceConfig) (*UserspaceDevice, error) {
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = defaultUserspaceMTU
+	}
+
+	var (
+		tunDev tun.Device
+		tnet   *netstack.Net
+		err    error
+	)
+	if cfg.TUN {
+		tunDev, err = tun.CreateTUN(cfg.Name, mtu)
+	} else {
+		tunDev, tnet, err = netstack.CreateNetTUN(cfg.Addresses, nil, mtu)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create tun: %w", err)
+	}
+
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), deviceLogger(cfg.Name))
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("bring device up: %w", err)
+	}
+	return &UserspaceDevice{name: cfg.Name, device: dev, net: tnet, tun: cfg.TUN, mtu: mtu}, nil
+}
+
+// Net returns the device's network stack, or nil for TUN devices.
+func (u *UserspaceDevice) Net() *netstack.Net {
+	return u.net
+}
+
+// MTU returns the device MTU.
+func (u *UserspaceDevice) MTU() int {
+	return u.mtu
+}
+
+// Device returns the current configuration and peer state.
+func (u *UserspaceDevice) Device(name string) (*wgtypes.Device, error) {
+	if name != u.name {
+		return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+	}
+	state, err := u.device.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+	return uapiGet(u.name, state)
+}
+
+// ConfigureDevice applies cfg to the device.
+func (u *UserspaceDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if name != u.name {
+		return fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+	}
+	return u.device.IpcSet(uapiSet(cfg))
+}
+
+// Close shuts the device down.
+func (u *UserspaceDevice) Close() error {
+	u.closeOnce.Do(u.device.Close)
+	return nil
+}
+
+// deviceLogger routes wireguard-go's logs to slog: errors at error level
+// and verbose messages at debug level.
+func deviceLogger(name string) *device.Logger {
+	logger := slog.Default().With("component", "wireguard-go", "interface", name)
+	return &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			if logger.Enabled(context.Background(), slog.LevelDebug) {
+				logger.Debug(fmt.Sprintf(format, args...))
+			}
+		},
+		Errorf: func(format string, args ...any) {
+			logger.Error(fmt.Sprintf(format, args...))
+		},
+	}
+}
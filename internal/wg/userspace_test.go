@@ -0,0 +1,90 @@
+package wg
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestUserspaceHandshake(t *testing.T) {
+	serverDev, err := NewUserspaceDevice(UserspaceConfig{
+		Name:      "wgs",
+		Addresses: []netip.Addr{netip.MustParseAddr("10.99.0.1")},
+	})
+	if err != nil {
+		t.Fatalf("server device: %v", err)
+	}
+	server := NewManagerWithClient(serverDev, "wgs", 0)
+	defer server.Close()
+	if err := server.Bootstrap(InterfaceConfig{}); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	serverState, err := serverDev.Device("wgs")
+	if err != nil {
+		t.Fatalf("server state: %v", err)
+	}
+	if serverState.ListenPort == 0 || serverState.PublicKey == (wgtypes.Key{}) {
+		t.Fatalf("expected listen port and key, got %d %s", serverState.ListenPort, serverState.PublicKey)
+	}
+
+	clientDev, err := NewUserspaceDevice(UserspaceConfig{
+		Name:      "wgc",
+		Addresses: []netip.Addr{netip.MustParseAddr("10.99.0.2")},
+	})
+	if err != nil {
+		t.Fatalf("client device: %v", err)
+	}
+	defer clientDev.Close()
+
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	allowed, err := AllowedIPNet(net.ParseIP("10.99.0.2"))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := server.AddPeer(clientKey.PublicKey(), nil, []net.IPNet{allowed}); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+
+	serverNet, err := AllowedIPNet(net.ParseIP("10.99.0.1"))
+	if err != nil {
+		t.Fatalf("allowed ip: %v", err)
+	}
+	if err := clientDev.ConfigureDevice("wgc", wgtypes.Config{
+		PrivateKey: &clientKey,
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  serverState.PublicKey,
+			Endpoint:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverState.ListenPort},
+			AllowedIPs: []net.IPNet{serverNet},
+		}},
+	}); err != nil {
+		t.Fatalf("configure client: %v", err)
+	}
+
+	conn, err := clientDev.Net().DialUDP(nil, &net.UDPAddr{IP: net.ParseIP("10.99.0.1"), Port: 9})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		// Once the tunnel is up the server stack answers with port
+		// unreachable, so write errors are expected and ignored.
+		_, _ = conn.Write([]byte("ping"))
+		stats, err := server.PeerStats()
+		if err != nil {
+			t.Fatalf("PeerStats: %v", err)
+		}
+		if !stats[clientKey.PublicKey().String()].LastHandshake.IsZero() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("no handshake recorded for client peer")
+}
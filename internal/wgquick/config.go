@@ -0,0 +1,53 @@
+package wgquick
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContentType is the media type of a rendered configuration.
+const ContentType = "text/plain; charset=utf-8"
+
+// Config describes a client configuration in wg-quick format.
+type Config struct {
+	PrivateKey string
+	Address    string
+	DNS        []string
+	MTU        int
+
+	PeerPublicKey       string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// Marshal renders the configuration as an [Interface]/[Peer] file.
+func (c Config) Marshal() []byte {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	writeField(&b, "PrivateKey", c.PrivateKey)
+	writeField(&b, "Address", c.Address)
+	writeField(&b, "DNS", strings.Join(c.DNS, ", "))
+	if c.MTU > 0 {
+		writeField(&b, "MTU", fmt.Sprint(c.MTU))
+	}
+
+	b.WriteString("\n[Peer]\n")
+	writeField(&b, "PublicKey", c.PeerPublicKey)
+	writeField(&b, "PresharedKey", c.PresharedKey)
+	writeField(&b, "Endpoint", c.Endpoint)
+	writeField(&b, "AllowedIPs", strings.Join(c.AllowedIPs, ", "))
+	if c.PersistentKeepalive > 0 {
+		writeField(&b, "PersistentKeepalive", fmt.Sprint(c.PersistentKeepalive))
+	}
+	return []byte(b.String())
+}
+
+// writeField writes "key = value", skipping empty values.
+func writeField(b *strings.Builder, key, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(b, "%s = %s\n", key, value)
+}
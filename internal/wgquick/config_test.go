@@ -0,0 +1,32 @@
+package wgquick
+
+import "testing"
+
+func TestConfigMarshal(t *testing.T) {
+	cfg := Config{
+		PrivateKey:          "cHJpdmF0ZQ==",
+		Address:             "10.66.0.2/32",
+		DNS:                 []string{"1.1.1.1", "1.0.0.1"},
+		MTU:                 1420,
+		PeerPublicKey:       "cHVibGlj",
+		Endpoint:            "vpn.example.com:51820",
+		AllowedIPs:          []string{"0.0.0.0/0"},
+		PersistentKeepalive: 25,
+	}
+
+	expected := `[Interface]
+PrivateKey = cHJpdmF0ZQ==
+Address = 10.66.0.2/32
+DNS = 1.1.1.1, 1.0.0.1
+MTU = 1420
+
+[Peer]
+PublicKey = cHVibGlj
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/0
+PersistentKeepalive = 25
+`
+	if got := string(cfg.Marshal()); got != expected {
+		t.Fatalf("unexpected config:\n%s\nwant:\n%s", got, expected)
+	}
+}
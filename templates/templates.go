@@ -0,0 +1,10 @@
+// Package templates holds the response templates compiled into the gateway.
+package templates
+
+import _ "embed"
+
+// PeerResponse is the default peer response template. It is used when no
+// template file is configured and as the fallback for failing templates.
+//
+//go:embed peer_response.json.tmpl
+var PeerResponse string